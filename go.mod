@@ -19,4 +19,5 @@ require (
 	github.com/tinylib/msgp v1.1.5 // indirect
 	golang.org/x/time v0.0.0-20210220033141-f8bda1e9f3ba // indirect
 	gopkg.in/DataDog/dd-trace-go.v1 v1.32.0
+	gopkg.in/yaml.v2 v2.4.0
 )
@@ -0,0 +1,99 @@
+package internal
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	imdsAllowedCIDRs    = parseAllowedCIDRs("IMDS_ALLOWED_CIDRS")
+	adminAllowedCIDRs   = parseAllowedCIDRs("ADMIN_ALLOWED_CIDRS")
+	metricsAllowedCIDRs = parseAllowedCIDRs("METRICS_ALLOWED_CIDRS")
+)
+
+// parseAllowedCIDRs parses the comma separated list of CIDRs (or single IPs) in the environment variable
+func parseAllowedCIDRs(key string) []*net.IPNet {
+	var result []*net.IPNet
+
+	for _, entry := range strings.Split(os.Getenv(key), ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		if !strings.Contains(entry, "/") {
+			if ip := net.ParseIP(entry); ip != nil && ip.To4() != nil {
+				entry += "/32"
+			} else {
+				entry += "/128"
+			}
+		}
+
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			log.Fatalf("Invalid CIDR in %s: %s", key, entry)
+		}
+
+		result = append(result, network)
+	}
+
+	return result
+}
+
+// routeGroup returns the name and allowlist of the routes the path belongs to
+func routeGroup(path string) (string, []*net.IPNet) {
+	switch {
+	case strings.HasPrefix(path, "/admin/"):
+		return "admin", adminAllowedCIDRs
+	case path == "/metrics" || path == "/healthz" || path == "/readyz":
+		return "metrics", metricsAllowedCIDRs
+	default:
+		return "imds", imdsAllowedCIDRs
+	}
+}
+
+// isAllowedSourceIP checks the IP against the allowlist, an empty allowlist allows everyone
+func isAllowedSourceIP(ip string, allowed []*net.IPNet) bool {
+	if len(allowed) == 0 {
+		return true
+	}
+
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+
+	for _, network := range allowed {
+		if network.Contains(parsed) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// withAccessControl denies requests from source IPs outside the allowlist of the route group
+func withAccessControl(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		group, allowed := routeGroup(r.URL.Path)
+		if isAllowedSourceIP(remoteIP(r.RemoteAddr), allowed) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		request := NewRequest(r, "access-control", r.URL.Path)
+		request.setLabel("route_group", group)
+		request.setResponseHeaders(w)
+		request.jsonErrors = group != "imds"
+		request.incrCounterWithLabels([]string{"access_denied"}, 1)
+
+		err := fmt.Errorf("Source IP %s is not allowed to access the %s routes", remoteIP(r.RemoteAddr), group)
+		auditLog.record(request, &auditEvent{Event: "access_denied", Details: err.Error()})
+		request.HandleError(err, errorKindForbidden, "source_ip_not_allowed", w)
+	})
+}
@@ -0,0 +1,57 @@
+package internal
+
+import (
+	"os"
+	"testing"
+)
+
+func TestRemoteIP(t *testing.T) {
+	tests := []struct {
+		addr     string
+		expected string
+	}{
+		{addr: "172.17.0.2:41234", expected: "172.17.0.2"},
+		{addr: "172.17.0.2", expected: "172.17.0.2"},
+		{addr: "[fd00::1]:41234", expected: "fd00::1"},
+		{addr: "[fd00::1]", expected: "fd00::1"},
+		{addr: "fd00::1", expected: "fd00::1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.addr, func(t *testing.T) {
+			if ip := remoteIP(tt.addr); ip != tt.expected {
+				t.Errorf("expected %q, got %q", tt.expected, ip)
+			}
+		})
+	}
+}
+
+func TestIsAllowedSourceIP(t *testing.T) {
+	tests := []struct {
+		name     string
+		cidrs    string
+		addr     string
+		expected bool
+	}{
+		{name: "empty allowlist", cidrs: "", addr: "172.17.0.2:41234", expected: true},
+		{name: "IPv4 in CIDR", cidrs: "172.17.0.0/16", addr: "172.17.0.2:41234", expected: true},
+		{name: "IPv4 outside CIDR", cidrs: "172.17.0.0/16", addr: "10.0.0.2:41234", expected: false},
+		{name: "IPv4 single IP", cidrs: "127.0.0.1", addr: "127.0.0.1:41234", expected: true},
+		{name: "IPv6 in CIDR", cidrs: "172.17.0.0/16, fd00::/64", addr: "[fd00::1]:41234", expected: true},
+		{name: "IPv6 outside CIDR", cidrs: "fd00::/64", addr: "[fd01::1]:41234", expected: false},
+		{name: "IPv6 single IP", cidrs: "::1", addr: "[::1]:41234", expected: true},
+		{name: "IPv4 against IPv6 CIDR", cidrs: "fd00::/64", addr: "172.17.0.2:41234", expected: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			os.Setenv("TEST_ALLOWED_CIDRS", tt.cidrs)
+			defer os.Unsetenv("TEST_ALLOWED_CIDRS")
+
+			allowed := parseAllowedCIDRs("TEST_ALLOWED_CIDRS")
+			if result := isAllowedSourceIP(remoteIP(tt.addr), allowed); result != tt.expected {
+				t.Errorf("expected %t, got %t", tt.expected, result)
+			}
+		})
+	}
+}
@@ -0,0 +1,315 @@
+package internal
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/iam"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+	docker "github.com/fsouza/go-dockerclient"
+	"github.com/gorilla/mux"
+)
+
+// credentialsTarget is a container and the role credentials it is served
+type credentialsTarget struct {
+	container  *docker.Container
+	roleARN    string
+	externalID string
+	cacheKey   string
+}
+
+// rotatedCredentials describes the new credentials of a container (without any secrets)
+//
+// Clients keep using the previous credentials until the expiration they were served with, so those are included
+type rotatedCredentials struct {
+	ContainerID         string `json:"container_id"`
+	RoleARN             string `json:"role_arn"`
+	AccessKeyID         string `json:"access_key_id,omitempty"`
+	Expiration          string `json:"expiration,omitempty"`
+	PreviousAccessKeyID string `json:"previous_access_key_id,omitempty"`
+	PreviousExpiration  string `json:"previous_expiration,omitempty"`
+	Error               string `json:"error,omitempty"`
+}
+
+// handles: POST /admin/credentials/{operation:flush|rotate}?role={arn}
+// handles: POST /admin/credentials/{operation:flush|rotate}?container={id}
+// handles: POST /admin/credentials/{operation:flush|rotate}?all=true
+//
+// Containers with the same role share the cached credentials (except for web identity credentials, which are cached
+// per container), so selecting a container flushes or rotates the credentials of every container with its role.
+// Every call is recorded in the audit log, including calls that are rejected or don't match any credentials
+func adminCredentialsHandler(w http.ResponseWriter, r *http.Request) {
+	operation := mux.Vars(r)["operation"]
+
+	request := NewRequest(r, "admin-credentials", "/admin/credentials/"+operation)
+	request.log.Infof("Handling %s %s from %s", r.Method, r.URL.String(), remoteIP(r.RemoteAddr))
+	request.jsonErrors = true
+	defer request.incrCounterWithLabels([]string{"http_request"}, 1)
+
+	// publish specific go-metadataproxy headers
+	request.setResponseHeaders(w)
+
+	query := r.URL.Query()
+	role, containerID, all := query.Get("role"), query.Get("container"), query.Get("all") == "true"
+
+	// failed is the error response of a call which did not flush or rotate anything
+	failed := func(err error, kind errorKind, description string) {
+		auditLog.record(request, &auditEvent{
+			Event:       "credentials_operation_failed",
+			ContainerID: containerID,
+			RoleARN:     role,
+			Details:     fmt.Sprintf("%s %s: %s", operation, description, err.Error()),
+			Denied:      kind != errorKindInternal,
+		})
+		request.HandleError(err, kind, description, w)
+	}
+
+	if r.Method != http.MethodPost {
+		failed(fmt.Errorf("Method %s is not allowed", r.Method), errorKindMethodNotAllowed, "method_not_allowed")
+		return
+	}
+
+	selectors := 0
+	for _, selected := range []bool{role != "", containerID != "", all} {
+		if selected {
+			selectors++
+		}
+	}
+
+	if selectors != 1 {
+		failed(fmt.Errorf("Exactly one of role, container or all=true is required"), errorKindBadRequest, "invalid_selector")
+		return
+	}
+
+	selector := "all"
+	switch {
+	case role != "":
+		selector = "role=" + role
+	case containerID != "":
+		selector = "container=" + containerID
+	}
+
+	if operation == "flush" && containerID == "" {
+		flushed := flushCredentials(role)
+
+		request.log.Infof("Flushed %d cached credentials (%s)", flushed, selector)
+		auditLog.record(request, &auditEvent{Event: "credentials_flushed", RoleARN: role, Details: fmt.Sprintf("Flushed %d cached credentials (%s)", flushed, selector)})
+
+		request.setLabel("response_code", "200")
+		sendJSONResponse(w, map[string]interface{}{"operation": operation, "flushed": flushed})
+		return
+	}
+
+	targets, err := findCredentialsTargets(role, containerID, request)
+	if err != nil {
+		failed(err, errorKindInternal, "could_not_find_containers")
+		return
+	}
+
+	if operation == "flush" {
+		flushed := 0
+		roles := make([]string, 0, len(targets))
+		for _, target := range targets {
+			roles = append(roles, target.roleARN)
+			if _, ok := permissionCache.Get(target.cacheKey); ok {
+				permissionCache.Delete(target.cacheKey)
+				flushed++
+			}
+		}
+
+		request.log.Infof("Flushed %d cached credentials (%s)", flushed, selector)
+		auditLog.record(request, &auditEvent{
+			Event:       "credentials_flushed",
+			ContainerID: containerID,
+			RoleARN:     strings.Join(roles, ","),
+			Details:     fmt.Sprintf("Flushed %d cached credentials (%s)", flushed, selector),
+		})
+
+		request.setLabel("response_code", "200")
+		sendJSONResponse(w, map[string]interface{}{"operation": operation, "flushed": flushed})
+		return
+	}
+
+	rotated := rotateCredentials(targets, request)
+
+	succeeded := 0
+	for _, credentials := range rotated {
+		if credentials.Error == "" {
+			succeeded++
+		}
+	}
+
+	// each target has its own credentials_rotated (or credentials_rotation_failed) event, this one covers the call
+	request.log.Infof("Rotated credentials of %d containers (%s)", succeeded, selector)
+	auditLog.record(request, &auditEvent{
+		Event:       "credentials_rotation_completed",
+		ContainerID: containerID,
+		RoleARN:     role,
+		Details:     fmt.Sprintf("Rotated credentials of %d of %d containers (%s)", succeeded, len(rotated), selector),
+	})
+
+	request.setLabel("response_code", "200")
+	sendJSONResponse(w, map[string]interface{}{"operation": operation, "rotated": rotated})
+}
+
+// flushCredentials removes the cached credentials of the role (or all roles), returning the number of removed entries
+func flushCredentials(roleARN string) int {
+	if roleARN == "" {
+		flushed := permissionCache.ItemCount()
+		permissionCache.Flush()
+		roleCache.Flush()
+		brokerCache.Flush()
+		return flushed
+	}
+
+	flushed := 0
+	for key := range permissionCache.Items() {
+		if key == roleARN || (strings.HasPrefix(key, "web-identity:") && strings.HasSuffix(key, ":"+roleARN)) {
+			permissionCache.Delete(key)
+			flushed++
+		}
+	}
+
+	// the broker role (used to assume other roles) could be the one rotated as well, for any source credentials
+	for key := range brokerCache.Items() {
+		if strings.HasSuffix(key, ":"+roleARN) {
+			brokerCache.Delete(key)
+			flushed++
+		}
+	}
+
+	for key, item := range roleCache.Items() {
+		if role, ok := item.Object.(*iam.Role); ok && role.Arn != nil && *role.Arn == roleARN {
+			roleCache.Delete(key)
+		}
+	}
+
+	return flushed
+}
+
+// findCredentialsTargets returns the running containers with the role (or the container ID), or all of them
+func findCredentialsTargets(roleARN, containerID string, request *Request) ([]*credentialsTarget, error) {
+	var ids []string
+	if containerID != "" {
+		ids = append(ids, containerID)
+	} else {
+		containers, err := dockerClient.ListContainers(docker.ListContainersOptions{
+			Filters: map[string][]string{"status": {"running"}},
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		for _, container := range containers {
+			ids = append(ids, container.ID)
+		}
+	}
+
+	targets := make([]*credentialsTarget, 0, len(ids))
+	seen := make(map[string]bool)
+	for _, id := range ids {
+		container, err := dockerClient.InspectContainer(id)
+		if err != nil {
+			if containerID != "" {
+				return nil, err
+			}
+
+			request.log.Warnf("Could not inspect container %s: %s", id, err.Error())
+			continue
+		}
+
+		roleName, err := findDockerContainerIAMRole(container, request)
+		if err != nil {
+			continue
+		}
+
+		role, err := readRoleFromAWS(roleName, request, request.datadogSpan)
+		if err != nil {
+			request.log.Warnf("Could not resolve role %s of container %s: %s", roleName, container.ID, err.Error())
+			continue
+		}
+
+		if roleARN != "" && *role.Arn != roleARN {
+			continue
+		}
+
+		target := &credentialsTarget{
+			container:  container,
+			roleARN:    *role.Arn,
+			externalID: findDockerContainerexternalID(container, request),
+			cacheKey:   *role.Arn,
+		}
+
+		if !isLocalMode && findDockerContainerWebIdentityTokenFile(container) != "" {
+			target.cacheKey = webIdentityCacheKey(container.ID, *role.Arn)
+		}
+
+		// containers sharing the role share the credentials, so they only need to be rotated once
+		if seen[target.cacheKey] {
+			continue
+		}
+
+		seen[target.cacheKey] = true
+		targets = append(targets, target)
+	}
+
+	return targets, nil
+}
+
+// rotateCredentials replaces the cached credentials with newly assumed ones, so containers receive new keys on their
+// next refresh. Clients keep using the old keys until the expiration they were served with (and STS keeps them valid
+// until then), and the old keys are kept cached if the role can't be assumed
+func rotateCredentials(targets []*credentialsTarget, request *Request) []*rotatedCredentials {
+	result := make([]*rotatedCredentials, 0, len(targets))
+
+	for _, target := range targets {
+		rotated := &rotatedCredentials{ContainerID: target.container.ID, RoleARN: target.roleARN}
+		result = append(result, rotated)
+
+		previous, expiration, hasPrevious := permissionCache.GetWithExpiration(target.cacheKey)
+		permissionCache.Delete(target.cacheKey)
+
+		if previousRole, ok := previous.(*sts.AssumeRoleResponse); ok && previousRole.Credentials != nil {
+			rotated.PreviousAccessKeyID = aws.StringValue(previousRole.Credentials.AccessKeyId)
+			if previousRole.Credentials.Expiration != nil {
+				rotated.PreviousExpiration = previousRole.Credentials.Expiration.Format(awsTimeLayoutResponse)
+			}
+		}
+
+		// the events are about the target container, not the admin client
+		event := func(event *auditEvent) *auditEvent {
+			event.ContainerID = target.container.ID
+			event.ContainerName = target.container.Name
+			event.ContainerImage = target.container.Config.Image
+			event.RoleARN = target.roleARN
+			return event
+		}
+
+		assumeRole, err := assumeRoleFromAWS(target.roleARN, target.externalID, target.container, request)
+		if err != nil {
+			// go-cache never expires entries with a negative TTL, so credentials expiring meanwhile are not restored
+			if ttl := time.Until(expiration); hasPrevious && ttl > 0 {
+				permissionCache.Set(target.cacheKey, previous, ttl)
+			}
+
+			rotated.Error = err.Error()
+			request.log.Errorf("Could not rotate credentials of %s: %s", target.roleARN, err.Error())
+			auditLog.record(request, event(&auditEvent{Event: "credentials_rotation_failed", Details: err.Error()}))
+			continue
+		}
+
+		rotated.AccessKeyID = *assumeRole.Credentials.AccessKeyId
+		rotated.Expiration = assumeRole.Credentials.Expiration.Format(awsTimeLayoutResponse)
+
+		rotatedEvent := event(&auditEvent{Event: "credentials_rotated", AccessKeyID: rotated.AccessKeyID, Expiration: rotated.Expiration})
+		if rotated.PreviousAccessKeyID != "" {
+			rotatedEvent.Details = fmt.Sprintf("Previous access key ID %s is used by clients until %s", rotated.PreviousAccessKeyID, rotated.PreviousExpiration)
+		}
+		auditLog.record(request, rotatedEvent)
+	}
+
+	return result
+}
@@ -0,0 +1,107 @@
+package internal
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+	"github.com/gorilla/mux"
+)
+
+// memoryAuditSink keeps the audit events in memory
+type memoryAuditSink struct {
+	events []*auditEvent
+}
+
+func (s *memoryAuditSink) write(line []byte) error {
+	event := &auditEvent{}
+	if err := json.Unmarshal(line, event); err != nil {
+		return err
+	}
+
+	s.events = append(s.events, event)
+	return nil
+}
+
+func TestAdminCredentialsAudit(t *testing.T) {
+	newFakeDockerDaemon(t)
+
+	router := mux.NewRouter()
+	router.HandleFunc("/admin/credentials/{operation:flush|rotate}", adminCredentialsHandler)
+
+	tests := []struct {
+		name          string
+		method        string
+		target        string
+		expectedCode  int
+		expectedEvent string
+		denied        bool
+	}{
+		{name: "rotate without matches", method: http.MethodPost, target: "/admin/credentials/rotate?role=arn:aws:iam::012345678910:role/unused", expectedCode: http.StatusOK, expectedEvent: "credentials_rotation_completed"},
+		{name: "flush without matches", method: http.MethodPost, target: "/admin/credentials/flush?role=arn:aws:iam::012345678910:role/unused", expectedCode: http.StatusOK, expectedEvent: "credentials_flushed"},
+		{name: "invalid selector", method: http.MethodPost, target: "/admin/credentials/rotate?all=true&role=arn:aws:iam::012345678910:role/unused", expectedCode: http.StatusBadRequest, expectedEvent: "credentials_operation_failed", denied: true},
+		{name: "method not allowed", method: http.MethodGet, target: "/admin/credentials/flush?all=true", expectedCode: http.StatusMethodNotAllowed, expectedEvent: "credentials_operation_failed", denied: true},
+		{name: "unknown container", method: http.MethodPost, target: "/admin/credentials/rotate?container=unknown", expectedCode: http.StatusNotFound, expectedEvent: "credentials_operation_failed"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sink := &memoryAuditSink{}
+
+			previous := auditLog.sinks
+			auditLog.sinks = []auditSink{sink}
+			defer func() { auditLog.sinks = previous }()
+
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, httptest.NewRequest(tt.method, tt.target, nil))
+
+			if w.Code != tt.expectedCode {
+				t.Errorf("expected %d, got %d", tt.expectedCode, w.Code)
+			}
+
+			if len(sink.events) != 1 {
+				t.Fatalf("expected a single audit event, got %d", len(sink.events))
+			}
+
+			if event := sink.events[0]; event.Event != tt.expectedEvent || event.Denied != tt.denied {
+				t.Errorf("expected %s (denied %t), got %s (denied %t)", tt.expectedEvent, tt.denied, event.Event, event.Denied)
+			}
+		})
+	}
+}
+
+func TestRotateCredentials(t *testing.T) {
+	defer func(local bool, credentials string) { isLocalMode, localCredentials = local, credentials }(isLocalMode, localCredentials)
+	isLocalMode, localCredentials = true, "fake"
+
+	roleARN := "arn:aws:iam::012345678910:role/web"
+	previous := &sts.AssumeRoleResponse{AssumeRoleOutput: &sts.AssumeRoleOutput{
+		Credentials: &sts.Credentials{AccessKeyId: aws.String("ASIAPREVIOUS"), Expiration: aws.Time(time.Date(2021, 6, 1, 13, 0, 0, 0, time.UTC))},
+	}}
+	permissionCache.Set(roleARN, previous, time.Hour)
+	defer permissionCache.Delete(roleARN)
+
+	request := NewRequest(httptest.NewRequest(http.MethodPost, "/admin/credentials/rotate?role="+roleARN, nil), "test", "/test")
+	target := &credentialsTarget{container: newFakeContainer("web", "172.17.0.2"), roleARN: roleARN, cacheKey: roleARN}
+
+	rotated := rotateCredentials([]*credentialsTarget{target}, request)
+	if len(rotated) != 1 || rotated[0].Error != "" {
+		t.Fatalf("expected the credentials to be rotated, got %+v", rotated)
+	}
+
+	if rotated[0].PreviousAccessKeyID != "ASIAPREVIOUS" || rotated[0].PreviousExpiration != "2021-06-01T13:00:00Z" {
+		t.Errorf("expected the previous credentials in the response, got %+v", rotated[0])
+	}
+
+	if rotated[0].AccessKeyID == "" || rotated[0].AccessKeyID == "ASIAPREVIOUS" {
+		t.Errorf("expected new credentials, got %s", rotated[0].AccessKeyID)
+	}
+
+	if request.container != nil {
+		t.Error("expected the admin request to have no container")
+	}
+}
@@ -0,0 +1,150 @@
+package internal
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	adminAddr           = os.Getenv("ADMIN_ADDR")
+	adminTLSCert        = os.Getenv("ADMIN_TLS_CERT")
+	adminTLSKey         = os.Getenv("ADMIN_TLS_KEY")
+	adminAuthToken      = os.Getenv("ADMIN_AUTH_TOKEN")
+	isAdminListenerOnly = os.Getenv("ADMIN_LISTENER_ONLY") != ""
+)
+
+// startAdminServer will start the HTTP server for the admin and metrics routes (blocking)
+func startAdminServer() {
+	log.Infof("Starting admin server at %s", adminAddr)
+
+	srv := &http.Server{
+		Handler:      configureAdminRouter(mux.NewRouter()),
+		Addr:         adminAddr,
+		WriteTimeout: 15 * time.Second,
+		ReadTimeout:  15 * time.Second,
+	}
+
+	if (adminTLSCert == "") != (adminTLSKey == "") {
+		log.Fatal("ADMIN_TLS_CERT and ADMIN_TLS_KEY must both be set")
+	}
+
+	var err error
+	if adminTLSCert != "" {
+		err = srv.ListenAndServeTLS(adminTLSCert, adminTLSKey)
+	} else {
+		err = srv.ListenAndServe()
+	}
+
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// configureAdminRouter will register the routes of the admin server
+func configureAdminRouter(r *mux.Router) http.Handler {
+	configureAdminRoutes(r)
+	r.NotFoundHandler = http.HandlerFunc(notFoundHandler)
+
+	// the admin token is required per route by configureAdminRoutes, like on the container-facing listener
+	return withAccessControl(r)
+}
+
+// withAdminAuth requires the ADMIN_AUTH_TOKEN as bearer token, if configured
+func withAdminAuth(next http.Handler) http.Handler {
+	if adminAuthToken == "" {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(adminAuthToken)) == 1 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		request := NewRequest(r, "admin-auth", r.URL.Path)
+		request.setResponseHeaders(w)
+		request.jsonErrors = true
+		w.Header().Set("WWW-Authenticate", "Bearer")
+
+		err := fmt.Errorf("Invalid or missing admin bearer token")
+		auditLog.record(request, &auditEvent{Event: "access_denied", Details: err.Error()})
+		request.HandleError(err, errorKindUnauthorized, "invalid_admin_token", w)
+	})
+}
+
+// configureAdminRoutes will register the admin API and metrics routes
+//
+// The routes require the ADMIN_AUTH_TOKEN (if configured) on any listener, so the container-facing listener doesn't
+// expose them when ADMIN_LISTENER_ONLY isn't set. The health checks are the exception, as load balancer and supervisor
+// probes usually can't send a token, they are restricted with METRICS_ALLOWED_CIDRS instead
+func configureAdminRoutes(r handlerFunc) {
+	r.HandleFunc("/metrics", withAdminAuth(http.HandlerFunc(metricsHandler)).ServeHTTP)
+	r.HandleFunc("/healthz", healthzHandler)
+	r.HandleFunc("/readyz", readyzHandler)
+
+	// the container details, credential operations and simulated events are only served with the admin token
+	if adminAuthToken != "" {
+		r.HandleFunc("/admin/containers", withAdminAuth(http.HandlerFunc(debugContainersHandler)).ServeHTTP)
+		r.HandleFunc("/admin/credentials/{operation:flush|rotate}", withAdminAuth(http.HandlerFunc(adminCredentialsHandler)).ServeHTTP)
+
+		if isEventSimulationEnabled {
+			r.HandleFunc("/admin/events", withAdminAuth(http.HandlerFunc(adminEventsHandler)).ServeHTTP)
+			r.HandleFunc("/admin/events/{id}", withAdminAuth(http.HandlerFunc(adminEventsHandler)).ServeHTTP)
+		}
+	}
+}
+
+// handles: GET /admin/events
+// handles: POST /admin/events
+// handles: DELETE /admin/events
+// handles: DELETE /admin/events/{id}
+func adminEventsHandler(w http.ResponseWriter, r *http.Request) {
+	request := NewRequest(r, "admin-events", "/admin/events")
+	request.jsonErrors = true
+	request.log.Infof("Handling %s %s from %s", r.Method, r.URL.String(), remoteIP(r.RemoteAddr))
+	defer request.incrCounterWithLabels([]string{"http_request"}, 1)
+
+	// publish specific go-metadataproxy headers
+	request.setResponseHeaders(w)
+
+	switch r.Method {
+	case http.MethodGet:
+		request.setLabel("response_code", "200")
+		sendJSONResponse(w, simulatedEvents.list())
+
+	case http.MethodPost:
+		event := &simulatedEvent{}
+		if err := json.NewDecoder(r.Body).Decode(event); err != nil {
+			request.HandleError(err, errorKindBadRequest, "invalid_event", w)
+			return
+		}
+
+		if err := simulatedEvents.add(event); err != nil {
+			request.HandleError(err, errorKindBadRequest, "invalid_event", w)
+			return
+		}
+
+		request.log.Infof("Added simulated %s event %s (container: '%s')", event.Type, event.ID, event.Container)
+		request.setLabel("response_code", "200")
+		sendJSONResponse(w, event)
+
+	case http.MethodDelete:
+		removed := simulatedEvents.remove(request.vars["id"], r.URL.Query().Get("container"))
+
+		request.log.Infof("Removed %d simulated events", removed)
+		request.setLabel("response_code", "200")
+		sendJSONResponse(w, map[string]int{"removed": removed})
+
+	default:
+		request.HandleError(fmt.Errorf("Method %s is not allowed", r.Method), errorKindMethodNotAllowed, "method_not_allowed", w)
+	}
+}
@@ -0,0 +1,45 @@
+package internal
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestAdminRoutesAuth(t *testing.T) {
+	defer func(token string) { adminAuthToken = token }(adminAuthToken)
+	adminAuthToken = "secret"
+
+	router := mux.NewRouter()
+	configureAdminRoutes(router)
+
+	tests := []struct {
+		path         string
+		token        string
+		expectedCode int
+	}{
+		{path: "/healthz", expectedCode: http.StatusOK},
+		{path: "/metrics", expectedCode: http.StatusUnauthorized},
+		{path: "/metrics", token: "wrong", expectedCode: http.StatusUnauthorized},
+		{path: "/admin/credentials/flush", expectedCode: http.StatusUnauthorized},
+		{path: "/admin/credentials/flush", token: "secret", expectedCode: http.StatusMethodNotAllowed},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			if tt.token != "" {
+				r.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, r)
+
+			if w.Code != tt.expectedCode {
+				t.Errorf("expected %d, got %d", tt.expectedCode, w.Code)
+			}
+		})
+	}
+}
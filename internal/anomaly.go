@@ -0,0 +1,150 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+	"github.com/patrickmn/go-cache"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	isAnomalyDetectionEnabled = os.Getenv("ENABLE_ANOMALY_DETECTION") != ""
+	anomalyMode               = getenvDefault("ANOMALY_MODE", "monitor")
+	anomalyWebhookURL         = os.Getenv("ANOMALY_WEBHOOK_URL")
+	anomalyWebhookClient      = &http.Client{Timeout: 5 * time.Second}
+	anomalySharedRoles        = strings.Split(os.Getenv("ANOMALY_SHARED_ROLES"), ",")
+	issuedCredentials         = cache.New(1*time.Hour, 10*time.Minute)
+)
+
+// issuedCredential is the container (and source IP) an access key ID was first issued to
+type issuedCredential struct {
+	containerID    string
+	containerImage string
+	sourceIP       string
+}
+
+// ConfigureAnomalyDetection will validate the anomaly detection settings
+func ConfigureAnomalyDetection() {
+	if !isAnomalyDetectionEnabled {
+		return
+	}
+
+	switch anomalyMode {
+	case "monitor", "deny":
+	default:
+		log.Fatalf("Invalid value for ANOMALY_MODE: %s (monitor or deny)", anomalyMode)
+	}
+
+	log.Infof("Enabling credential anomaly detection (mode: %s)", anomalyMode)
+}
+
+// detectCredentialAnomalies compares the credentials about to be handed out with the earlier requests for them
+//
+// An error is only returned in deny mode, in which case the credentials must not be handed out
+func detectCredentialAnomalies(request *Request, roleARN string, assumeRole *sts.AssumeRoleResponse) error {
+	if !isAnomalyDetectionEnabled || request.container == nil {
+		return nil
+	}
+
+	container := request.container
+	image := ""
+	if container.Config != nil {
+		image = container.Config.Image
+	}
+
+	sourceIP := remoteIP(request.request.RemoteAddr)
+	accessKeyID := ""
+	if assumeRole.Credentials.AccessKeyId != nil {
+		accessKeyID = *assumeRole.Credentials.AccessKeyId
+	}
+
+	var anomalies []*auditEvent
+
+	// cached credentials should only be shared between containers of the same image, unless the role is meant to be shared
+	previous, ok := issuedCredentials.Get(accessKeyID)
+	if ok && !isSharedRole(roleARN) {
+		issued := previous.(*issuedCredential)
+		if issued.containerID != container.ID && issued.containerImage != image {
+			anomalies = append(anomalies, &auditEvent{
+				Anomaly: "credentials_shared_across_images",
+				Details: fmt.Sprintf("Credentials issued to container %s (image %s, IP %s) requested by container %s (image %s, IP %s)", issued.containerID, issued.containerImage, issued.sourceIP, container.ID, image, sourceIP),
+			})
+		}
+	}
+
+	if len(anomalies) == 0 {
+		if !ok && accessKeyID != "" {
+			issuedCredentials.Set(accessKeyID, &issuedCredential{containerID: container.ID, containerImage: image, sourceIP: sourceIP}, credentialsTTL(*assumeRole.Credentials.Expiration))
+		}
+
+		return nil
+	}
+
+	for _, anomaly := range anomalies {
+		anomaly.Event = "anomaly_detected"
+		anomaly.RoleARN = roleARN
+		anomaly.AccessKeyID = accessKeyID
+		anomaly.Denied = anomalyMode == "deny"
+
+		request.log.Warnf("Credential anomaly %s: %s", anomaly.Anomaly, anomaly.Details)
+		request.setLabel("anomaly", anomaly.Anomaly)
+		request.incrCounterWithLabels([]string{"anomaly"}, 1)
+
+		auditLog.record(request, anomaly)
+		go sendAnomalyWebhook(anomaly)
+	}
+
+	if anomalyMode == "deny" {
+		return forbiddenErrorf("Denied credentials for %s due to anomaly %s", roleARN, anomalies[0].Anomaly)
+	}
+
+	return nil
+}
+
+// isSharedRole returns if the role is the DEFAULT_ROLE or in ANOMALY_SHARED_ROLES (as ARN or name), which containers
+// with different images are expected to share
+func isSharedRole(roleARN string) bool {
+	for _, role := range append([]string{defaultRole}, anomalySharedRoles...) {
+		role = strings.TrimLeft(strings.TrimSpace(role), "/")
+		if role == "" {
+			continue
+		}
+
+		if role == roleARN || strings.HasSuffix(roleARN, ":role/"+role) || strings.HasSuffix(roleARN, "/"+role) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// sendAnomalyWebhook posts the anomaly (as JSON) to ANOMALY_WEBHOOK_URL
+func sendAnomalyWebhook(anomaly *auditEvent) {
+	if anomalyWebhookURL == "" {
+		return
+	}
+
+	data, err := json.Marshal(anomaly)
+	if err != nil {
+		log.Errorf("Could not encode anomaly webhook: %s", err.Error())
+		return
+	}
+
+	resp, err := anomalyWebhookClient.Post(anomalyWebhookURL, "application/json", bytes.NewReader(data))
+	if err != nil {
+		log.Errorf("Could not send anomaly webhook: %s", err.Error())
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		log.Errorf("Anomaly webhook returned %d", resp.StatusCode)
+	}
+}
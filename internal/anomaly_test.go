@@ -0,0 +1,107 @@
+package internal
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+	docker "github.com/fsouza/go-dockerclient"
+)
+
+func TestDetectCredentialAnomalies(t *testing.T) {
+	defer func(enabled bool, mode, role string, shared []string) {
+		isAnomalyDetectionEnabled, anomalyMode, defaultRole, anomalySharedRoles = enabled, mode, role, shared
+	}(isAnomalyDetectionEnabled, anomalyMode, defaultRole, anomalySharedRoles)
+	isAnomalyDetectionEnabled, anomalyMode = true, "deny"
+	defaultRole, anomalySharedRoles = "default", []string{"arn:aws:iam::012345678910:role/shared"}
+
+	newContainer := func(id, image string) *docker.Container {
+		return &docker.Container{ID: id, Config: &docker.Config{Image: image}}
+	}
+
+	type call struct {
+		container   *docker.Container
+		sourceIP    string
+		roleARN     string
+		accessKeyID string
+	}
+
+	tests := []struct {
+		name    string
+		earlier []call
+		call    call
+		wantErr bool
+	}{
+		{
+			name:    "same container",
+			earlier: []call{{newContainer("web", "web:1"), "172.17.0.2", "arn:aws:iam::012345678910:role/web", "ASIAWEB"}},
+			call:    call{newContainer("web", "web:1"), "172.17.0.2", "arn:aws:iam::012345678910:role/web", "ASIAWEB"},
+		},
+		{
+			name:    "same container from another network",
+			earlier: []call{{newContainer("web", "web:1"), "172.17.0.2", "arn:aws:iam::012345678910:role/web", "ASIAWEB"}},
+			call:    call{newContainer("web", "web:1"), "172.18.0.2", "arn:aws:iam::012345678910:role/web", "ASIAWEB"},
+		},
+		{
+			name:    "another container with the same image",
+			earlier: []call{{newContainer("web-1", "web:1"), "172.17.0.2", "arn:aws:iam::012345678910:role/web", "ASIAWEB"}},
+			call:    call{newContainer("web-2", "web:1"), "172.17.0.3", "arn:aws:iam::012345678910:role/web", "ASIAWEB"},
+		},
+		{
+			name:    "another container with a different image",
+			earlier: []call{{newContainer("web", "web:1"), "172.17.0.2", "arn:aws:iam::012345678910:role/web", "ASIAWEB"}},
+			call:    call{newContainer("intruder", "intruder:1"), "172.17.0.9", "arn:aws:iam::012345678910:role/web", "ASIAWEB"},
+			wantErr: true,
+		},
+		{
+			name:    "different images with new credentials",
+			earlier: []call{{newContainer("web", "web:1"), "172.17.0.2", "arn:aws:iam::012345678910:role/web", "ASIAWEB"}},
+			call:    call{newContainer("worker", "worker:1"), "172.17.0.3", "arn:aws:iam::012345678910:role/web", "ASIAROTATED"},
+		},
+		{
+			name:    "different images sharing the default role",
+			earlier: []call{{newContainer("web", "web:1"), "172.17.0.2", "arn:aws:iam::012345678910:role/default", "ASIADEFAULT"}},
+			call:    call{newContainer("worker", "worker:1"), "172.17.0.3", "arn:aws:iam::012345678910:role/default", "ASIADEFAULT"},
+		},
+		{
+			name:    "different images sharing a configured role",
+			earlier: []call{{newContainer("web", "web:1"), "172.17.0.2", "arn:aws:iam::012345678910:role/shared", "ASIASHARED"}},
+			call:    call{newContainer("worker", "worker:1"), "172.17.0.3", "arn:aws:iam::012345678910:role/shared", "ASIASHARED"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			issuedCredentials.Flush()
+
+			detect := func(c call) error {
+				r := httptest.NewRequest("GET", "/latest/meta-data/iam/security-credentials/role", nil)
+				r.RemoteAddr = c.sourceIP + ":41234"
+
+				request := NewRequest(r, "test", "/test")
+				request.container = c.container
+
+				assumeRole := &sts.AssumeRoleResponse{AssumeRoleOutput: &sts.AssumeRoleOutput{
+					Credentials: &sts.Credentials{AccessKeyId: aws.String(c.accessKeyID), Expiration: aws.Time(time.Now().Add(time.Hour))},
+				}}
+				return detectCredentialAnomalies(request, c.roleARN, assumeRole)
+			}
+
+			for _, c := range tt.earlier {
+				if err := detect(c); err != nil {
+					t.Fatalf("unexpected anomaly for the earlier request: %s", err)
+				}
+			}
+
+			err := detect(tt.call)
+			if tt.wantErr && err == nil {
+				t.Error("expected an anomaly")
+			}
+			if !tt.wantErr && err != nil {
+				t.Errorf("unexpected anomaly: %s", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,301 @@
+package internal
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log/syslog"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	metrics "github.com/armon/go-metrics"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	auditLogFile       = os.Getenv("AUDIT_LOG_FILE")
+	auditLogMaxSize    = getenvDefault("AUDIT_LOG_MAX_SIZE", "100")
+	auditLogMaxBackups = getenvDefault("AUDIT_LOG_MAX_BACKUPS", "5")
+	auditLogSyslog     = os.Getenv("AUDIT_LOG_SYSLOG")
+	auditLogSyslogTag  = getenvDefault("AUDIT_LOG_SYSLOG_TAG", "go-metadataproxy")
+	isAuditHashChained = os.Getenv("AUDIT_LOG_HASH_CHAIN") != ""
+	auditLog           = &auditLogger{}
+)
+
+// auditEvent is a single entry in the audit log
+type auditEvent struct {
+	Time           string `json:"time"`
+	Event          string `json:"event"`
+	RequestID      string `json:"request_id"`
+	Handler        string `json:"handler,omitempty"`
+	SourceIP       string `json:"source_ip"`
+	ContainerID    string `json:"container_id,omitempty"`
+	ContainerName  string `json:"container_name,omitempty"`
+	ContainerImage string `json:"container_image,omitempty"`
+	RoleARN        string `json:"role_arn,omitempty"`
+	AccessKeyID    string `json:"access_key_id,omitempty"`
+	Expiration     string `json:"expiration,omitempty"`
+	Cached         bool   `json:"cached"`
+	Anomaly        string `json:"anomaly,omitempty"`
+	Details        string `json:"details,omitempty"`
+	Denied         bool   `json:"denied,omitempty"`
+	PrevHash       string `json:"prev_hash,omitempty"`
+	Hash           string `json:"hash,omitempty"`
+}
+
+// auditSink is a destination for audit log lines
+type auditSink interface {
+	write(line []byte) error
+}
+
+// auditLogger writes audit events to the configured sinks, in order
+type auditLogger struct {
+	sync.Mutex
+	sinks    []auditSink
+	lastHash string
+}
+
+// ConfigureAudit will setup the audit log sinks
+func ConfigureAudit() {
+	if auditLogFile != "" {
+		maxSize, err := strconv.ParseInt(auditLogMaxSize, 10, 64)
+		if err != nil || maxSize < 0 {
+			log.Fatalf("Invalid value for AUDIT_LOG_MAX_SIZE: %s", auditLogMaxSize)
+		}
+
+		maxBackups, err := strconv.Atoi(auditLogMaxBackups)
+		if err != nil || maxBackups < 0 {
+			log.Fatalf("Invalid value for AUDIT_LOG_MAX_BACKUPS: %s", auditLogMaxBackups)
+		}
+
+		sink, err := newAuditFileSink(auditLogFile, maxSize*1024*1024, maxBackups)
+		if err != nil {
+			log.Fatalf("Could not open AUDIT_LOG_FILE: %s", err.Error())
+		}
+
+		// continue the hash chain of the existing audit log
+		if isAuditHashChained {
+			auditLog.lastHash = lastAuditHash(auditLogFile, fmt.Sprintf("%s.1", auditLogFile))
+		}
+
+		log.Infof("Writing audit log to %s", auditLogFile)
+		auditLog.sinks = append(auditLog.sinks, sink)
+	}
+
+	if auditLogSyslog != "" {
+		sink, err := newAuditSyslogSink(auditLogSyslog, auditLogSyslogTag)
+		if err != nil {
+			log.Fatalf("Could not connect to AUDIT_LOG_SYSLOG: %s", err.Error())
+		}
+
+		log.Infof("Writing audit log to syslog (%s)", auditLogSyslog)
+		auditLog.sinks = append(auditLog.sinks, sink)
+	}
+}
+
+// auditCredentialsIssued records the credentials handed out to the caller of the request
+func auditCredentialsIssued(request *Request, roleARN string, assumeRole *sts.AssumeRoleResponse) {
+	event := &auditEvent{
+		Event:      "credentials_issued",
+		RoleARN:    roleARN,
+		Cached:     request.cachedRole,
+		Expiration: assumeRole.Credentials.Expiration.Format(awsTimeLayoutResponse),
+	}
+
+	if assumeRole.Credentials.AccessKeyId != nil {
+		event.AccessKeyID = *assumeRole.Credentials.AccessKeyId
+	}
+
+	auditLog.record(request, event)
+}
+
+// record fills in the request details of the event, and writes it to all sinks
+func (a *auditLogger) record(request *Request, event *auditEvent) {
+	event.Time = time.Now().UTC().Format(time.RFC3339Nano)
+	event.RequestID = request.id
+	event.Handler = request.handler
+	event.SourceIP = remoteIP(request.request.RemoteAddr)
+
+	if container := request.container; container != nil {
+		event.ContainerID = container.ID
+		event.ContainerName = container.Name
+		if container.Config != nil {
+			event.ContainerImage = container.Config.Image
+		}
+	}
+
+	if len(a.sinks) == 0 {
+		return
+	}
+
+	a.Lock()
+	defer a.Unlock()
+
+	if isAuditHashChained {
+		event.PrevHash = a.lastHash
+		event.Hash = ""
+
+		data, err := json.Marshal(event)
+		if err != nil {
+			a.fail(request, err)
+			return
+		}
+
+		sum := sha256.Sum256(append([]byte(event.PrevHash), data...))
+		event.Hash = hex.EncodeToString(sum[:])
+		a.lastHash = event.Hash
+	}
+
+	line, err := json.Marshal(event)
+	if err != nil {
+		a.fail(request, err)
+		return
+	}
+
+	for _, sink := range a.sinks {
+		if err := sink.write(line); err != nil {
+			a.fail(request, err)
+		}
+	}
+}
+
+func (a *auditLogger) fail(request *Request, err error) {
+	request.log.Errorf("Could not write audit log: %s", err.Error())
+	metrics.IncrCounter([]string{telemetryPrefix, "audit_log_error"}, 1)
+}
+
+// lastAuditHash returns the hash of the last entry in the first (non-empty) file
+func lastAuditHash(files ...string) string {
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			continue
+		}
+
+		lines := bytes.Split(bytes.TrimSpace(data), []byte("\n"))
+		if len(lines[len(lines)-1]) == 0 {
+			continue
+		}
+
+		event := &auditEvent{}
+		if err := json.Unmarshal(lines[len(lines)-1], event); err != nil {
+			log.Warnf("Could not read the last hash from %s, starting a new hash chain: %s", file, err.Error())
+			return ""
+		}
+
+		return event.Hash
+	}
+
+	return ""
+}
+
+// auditFileSink writes JSON lines to a file, rotating it when it grows beyond maxSize
+type auditFileSink struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+	file       *os.File
+	size       int64
+}
+
+func newAuditFileSink(path string, maxSize int64, maxBackups int) (*auditFileSink, error) {
+	sink := &auditFileSink{path: path, maxSize: maxSize, maxBackups: maxBackups}
+	if err := sink.open(); err != nil {
+		return nil, err
+	}
+
+	return sink, nil
+}
+
+func (s *auditFileSink) open() error {
+	file, err := os.OpenFile(s.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	s.file = file
+	s.size = info.Size()
+	return nil
+}
+
+func (s *auditFileSink) write(line []byte) error {
+	if s.maxSize > 0 && s.size > 0 && s.size+int64(len(line))+1 > s.maxSize {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+	}
+
+	n, err := s.file.Write(append(line, '\n'))
+	s.size += int64(n)
+	return err
+}
+
+// rotate moves audit.log to audit.log.1 (and audit.log.1 to audit.log.2, ...), keeping maxBackups files
+func (s *auditFileSink) rotate() error {
+	if err := s.file.Close(); err != nil {
+		return err
+	}
+
+	if s.maxBackups == 0 {
+		os.Remove(s.path)
+		return s.open()
+	}
+
+	os.Remove(fmt.Sprintf("%s.%d", s.path, s.maxBackups))
+	for i := s.maxBackups - 1; i >= 1; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", s.path, i), fmt.Sprintf("%s.%d", s.path, i+1))
+	}
+
+	if err := os.Rename(s.path, s.path+".1"); err != nil {
+		return err
+	}
+
+	return s.open()
+}
+
+// auditSyslogSink writes JSON lines to the local syslog daemon, or a remote one (e.g. udp://logs:514)
+type auditSyslogSink struct {
+	writer *syslog.Writer
+}
+
+func newAuditSyslogSink(address, tag string) (*auditSyslogSink, error) {
+	priority := syslog.LOG_INFO | syslog.LOG_AUTH
+
+	if address == "local" {
+		writer, err := syslog.New(priority, tag)
+		if err != nil {
+			return nil, err
+		}
+
+		return &auditSyslogSink{writer: writer}, nil
+	}
+
+	u, err := url.Parse(address)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return nil, fmt.Errorf("Invalid syslog address %s (local, udp://host:port or tcp://host:port)", address)
+	}
+
+	writer, err := syslog.Dial(u.Scheme, u.Host, priority, tag)
+	if err != nil {
+		return nil, err
+	}
+
+	return &auditSyslogSink{writer: writer}, nil
+}
+
+func (s *auditSyslogSink) write(line []byte) error {
+	return s.writer.Info(string(line))
+}
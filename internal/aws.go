@@ -1,14 +1,20 @@
 package internal
 
 import (
+	"context"
 	"fmt"
+	"os"
 	"strings"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/arn"
+	"github.com/aws/aws-sdk-go-v2/aws/ec2metadata"
+	"github.com/aws/aws-sdk-go-v2/aws/endpoints"
 	"github.com/aws/aws-sdk-go-v2/aws/external"
 	"github.com/aws/aws-sdk-go-v2/service/iam"
 	"github.com/aws/aws-sdk-go-v2/service/sts"
+	docker "github.com/fsouza/go-dockerclient"
 	awstrace "github.com/jippi/go-metadataproxy/internal/trace/aws"
 	"github.com/patrickmn/go-cache"
 	log "github.com/sirupsen/logrus"
@@ -20,23 +26,144 @@ const (
 )
 
 var (
+	awsConfig       aws.Config
 	iamService      *iam.Client
 	stsService      *sts.Client
+	stsAnonymous    *sts.Client
 	roleCache       = cache.New(1*time.Hour, 15*time.Minute)
 	permissionCache = cache.New(5*time.Minute, 10*time.Minute)
+	brokerCache     = cache.New(5*time.Minute, 10*time.Minute)
+	brokerRole      = os.Getenv("BROKER_ROLE")
+	brokerRoles     = getenvMap("BROKER_ROLES")
+	awsPartition    endpoints.Partition
+	stsEndpointMode = os.Getenv("AWS_STS_REGIONAL_ENDPOINTS")
 )
 
 // ConfigureAWS will setup the iam and sts services needed during normal operations
 func ConfigureAWS() {
+	if isLocalMode {
+		configureLocalAWS()
+		return
+	}
+
 	log.Info("Creating AWS client")
 	cfg, err := external.LoadDefaultAWSConfig()
 	if err != nil {
 		log.Fatalf("Unable to load AWS SDK config, " + err.Error())
 	}
+	configurePartition(&cfg)
 	cfg = awstrace.WrapSession(cfg)
 
+	awsConfig = cfg
 	iamService = iam.New(cfg)
 	stsService = sts.New(cfg)
+
+	anonymousCfg := cfg.Copy()
+	anonymousCfg.Credentials = aws.AnonymousCredentials
+	stsAnonymous = sts.New(anonymousCfg)
+
+	configureSourceCredentials(cfg)
+}
+
+// configurePartition will detect the AWS region and partition of the host, and configure the STS endpoints
+func configurePartition(cfg *aws.Config) {
+	if cfg.Region == "" && isMetadataEmulated {
+		if region, ok := lookupMetadataDocument(metadataDocument, "meta-data/placement/region"); ok {
+			cfg.Region = fmt.Sprint(region)
+		}
+	}
+
+	if cfg.Region == "" {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+
+		metadataCfg := cfg.Copy()
+		metadataCfg.EndpointResolver = aws.ResolveWithEndpointURL(upstreamURL("/latest").String())
+
+		region, err := ec2metadata.New(metadataCfg).Region(ctx)
+		if err != nil {
+			log.Warnf("Could not detect AWS region from instance metadata: %s", err.Error())
+		}
+		cfg.Region = region
+	}
+
+	awsPartition = findPartition(cfg.Region)
+	log.Infof("Using AWS region '%s' in partition '%s'", cfg.Region, awsPartition.ID())
+
+	switch stsEndpointMode {
+	case "":
+		// use the SDK endpoint resolution
+	case "regional", "legacy":
+		// regional endpoints can't be resolved without a region, which would only fail on the first AssumeRole
+		if stsEndpointMode == "regional" && cfg.Region == "" {
+			log.Fatal("AWS_STS_REGIONAL_ENDPOINTS=regional requires the AWS region, which could not be detected (set AWS_REGION)")
+		}
+
+		log.Infof("Using %s STS endpoints", stsEndpointMode)
+		cfg.EndpointResolver = stsEndpointResolver(cfg.EndpointResolver, stsEndpointMode)
+	default:
+		log.Fatalf("Invalid value for AWS_STS_REGIONAL_ENDPOINTS: %s (regional or legacy)", stsEndpointMode)
+	}
+}
+
+// findPartition returns the AWS_PARTITION, or the partition of the region, defaulting to the aws partition
+func findPartition(region string) endpoints.Partition {
+	partitions := endpoints.NewDefaultResolver().Partitions()
+
+	if id := os.Getenv("AWS_PARTITION"); id != "" {
+		partition, ok := partitions.ForPartition(id)
+		if !ok {
+			log.Fatalf("Unknown AWS partition: %s", id)
+		}
+
+		return partition
+	}
+
+	if partition, ok := partitions.ForRegion(region); ok {
+		return partition
+	}
+
+	partition, _ := partitions.ForPartition("aws")
+	return partition
+}
+
+// stsEndpointResolver wraps the resolver, resolving STS to either the regional or the global (legacy) endpoint
+func stsEndpointResolver(resolver aws.EndpointResolver, mode string) aws.EndpointResolver {
+	return aws.EndpointResolverFunc(func(service, region string) (aws.Endpoint, error) {
+		if service != sts.EndpointsID {
+			return resolver.ResolveEndpoint(service, region)
+		}
+
+		// only the aws partition has a global STS endpoint
+		if mode == "legacy" && awsPartition.ID() == "aws" {
+			return resolver.ResolveEndpoint(service, "aws-global")
+		}
+
+		if mode == "legacy" {
+			return resolver.ResolveEndpoint(service, region)
+		}
+
+		return aws.Endpoint{
+			URL:           fmt.Sprintf("https://sts.%s.%s", region, awsPartition.DNSSuffix()),
+			PartitionID:   awsPartition.ID(),
+			SigningName:   sts.EndpointsID,
+			SigningRegion: region,
+		}, nil
+	})
+}
+
+// parseRoleARN returns the parsed ARN if the role is an IAM role ARN (in any partition)
+func parseRoleARN(role string) (arn.ARN, bool) {
+	if !arn.IsARN(role) {
+		return arn.ARN{}, false
+	}
+
+	parsed, err := arn.Parse(role)
+	if err != nil || parsed.Service != "iam" || !strings.HasPrefix(parsed.Resource, "role/") {
+		return arn.ARN{}, false
+	}
+
+	return parsed, true
 }
 
 func readRoleFromAWS(role string, request *Request, parentSpan tracer.Span) (*iam.Role, error) {
@@ -55,25 +182,27 @@ func readRoleFromAWS(role string, request *Request, parentSpan tracer.Span) (*ia
 
 	request.setLabel("aws.cache.role", "miss")
 
-	if strings.Contains(role, "@") { // IAM_ROLE=my-role@012345678910
-		request.log.Infof("Constructing IAM role info for %s manually", role)
-		chunks := strings.SplitN(role, "@", 2)
-		nameChunks := strings.Split(chunks[0], "/")
+	if parsed, ok := parseRoleARN(role); ok { // IAM_ROLE=arn:aws:iam::012345678910:role/my-role
+		request.log.Infof("Using IAM role ARN as is for %s", role)
+
+		nameChunks := strings.Split(strings.TrimPrefix(parsed.Resource, "role/"), "/")
 
 		roleObject = &iam.Role{
-			Arn:      aws.String(fmt.Sprintf("arn:aws:iam::%s:role/%s", chunks[1], strings.TrimLeft(chunks[0], "/"))),
+			Arn:      aws.String(role),
 			RoleName: aws.String(nameChunks[len(nameChunks)-1]),
 		}
-	} else if strings.HasPrefix(role, "arn:aws:iam") { // IAM_ROLE=arn:aws:iam::012345678910:role/my-role
-		request.log.Infof("Using IAM role ARN as is for %s", role)
-
-		chunks := strings.SplitN(role, ":role/", 2)
-		nameChunks := strings.Split(chunks[1], "/")
+	} else if strings.Contains(role, "@") { // IAM_ROLE=my-role@012345678910
+		request.log.Infof("Constructing IAM role info for %s manually", role)
+		chunks := strings.SplitN(role, "@", 2)
+		nameChunks := strings.Split(chunks[0], "/")
 
 		roleObject = &iam.Role{
-			Arn:      aws.String(role),
+			Arn:      aws.String(fmt.Sprintf("arn:%s:iam::%s:role/%s", awsPartition.ID(), chunks[1], strings.TrimLeft(chunks[0], "/"))),
 			RoleName: aws.String(nameChunks[len(nameChunks)-1]),
 		}
+	} else if isLocalMode { // IAM_ROLE=my-role (in local mode)
+		request.log.Infof("Constructing IAM role info for %s in the local account", role)
+		roleObject = readRoleLocally(role)
 	} else { // IAM_ROLE=my-role
 		request.log.Infof("Requesting IAM role info for %s from AWS", role)
 		req := iamService.GetRoleRequest(&iam.GetRoleInput{
@@ -110,23 +239,38 @@ func constructAssumeRoleInput(arn string, externalID string) *sts.AssumeRoleInpu
 	}
 }
 
-func assumeRoleFromAWS(arn, externalID string, request *Request) (*sts.AssumeRoleResponse, error) {
+func assumeRoleFromAWS(arn, externalID string, container *docker.Container, request *Request) (*sts.AssumeRoleResponse, error) {
 	span := tracer.StartSpan("assumeRoleFromAWS", tracer.ChildOf(request.datadogSpan.Context()))
 	defer span.Finish()
 
 	span.SetTag("aws.arn", arn)
 	span.SetTag("aws.external_id", externalID)
 
+	if isLocalMode {
+		return assumeRoleLocally(arn, request, span)
+	}
+
+	if tokenFile := findDockerContainerWebIdentityTokenFile(container); tokenFile != "" {
+		return assumeRoleWithWebIdentityFromAWS(arn, tokenFile, container, request, span)
+	}
+
 	request.log.Infof("Looking for STS Assume Role for %s", arn)
 	if assumedRole, ok := permissionCache.Get(arn); ok {
-		request.setLabel("aws.cache.assume_role", "hit")
+		request.setAssumeRoleCache(true)
 		request.log.Infof("Found STS Assume Role %s in cache", arn)
 		return assumedRole.(*sts.AssumeRoleResponse), nil
 	}
 
-	request.setLabel("aws.cache.assume_role", "miss")
+	request.setAssumeRoleCache(false)
+
+	client, err := stsClientForRole(arn, request, span)
+	if err != nil {
+		span.Finish(tracer.WithError(err))
+		return nil, err
+	}
+
 	request.log.Infof("Requesting STS Assume Role info for %s from AWS", arn)
-	req := stsService.AssumeRoleRequest(constructAssumeRoleInput(arn, externalID))
+	req := client.AssumeRoleRequest(constructAssumeRoleInput(arn, externalID))
 
 	assumedRole, err := req.Send(tracer.ContextWithSpan(req.Context(), span))
 	if err != nil {
@@ -134,12 +278,178 @@ func assumeRoleFromAWS(arn, externalID string, request *Request) (*sts.AssumeRol
 		return nil, err
 	}
 
-	ttl := assumedRole.Credentials.Expiration.Sub(time.Now()) - getExpirationOffset()
+	recordSTSSuccess(client)
+
+	ttl := credentialsTTL(*assumedRole.Credentials.Expiration)
 	request.log.Infof("Will cache STS Assumed Role info for %s in %s", arn, ttl.String())
 	permissionCache.Set(arn, assumedRole, ttl)
 	return assumedRole, nil
 }
 
+// webIdentityCacheKey returns the permissionCache key of the web identity credentials of a container
+func webIdentityCacheKey(containerID, arn string) string {
+	return fmt.Sprintf("web-identity:%s:%s", containerID, arn)
+}
+
+// assumeRoleWithWebIdentityFromAWS assumes the role using the web identity token provided by the container
+//
+// The response is cached per container, since the token (and thus the identity) belongs to the container
+func assumeRoleWithWebIdentityFromAWS(arn, tokenFile string, container *docker.Container, request *Request, parentSpan tracer.Span) (*sts.AssumeRoleResponse, error) {
+	span := tracer.StartSpan("assumeRoleWithWebIdentityFromAWS", tracer.ChildOf(parentSpan.Context()))
+	defer span.Finish()
+
+	span.SetTag("aws.arn", arn)
+	span.SetTag("aws.web_identity_token_file", tokenFile)
+
+	cacheKey := webIdentityCacheKey(container.ID, arn)
+
+	request.log.Infof("Looking for STS Assume Role With Web Identity for %s", arn)
+	if assumedRole, ok := permissionCache.Get(cacheKey); ok {
+		request.setAssumeRoleCache(true)
+		request.log.Infof("Found STS Assume Role With Web Identity %s in cache", arn)
+		return assumedRole.(*sts.AssumeRoleResponse), nil
+	}
+
+	request.setAssumeRoleCache(false)
+
+	token, err := readDockerContainerFile(container, tokenFile)
+	if err != nil {
+		span.Finish(tracer.WithError(err))
+		return nil, err
+	}
+
+	request.log.Infof("Requesting STS Assume Role With Web Identity info for %s from AWS", arn)
+	req := stsAnonymous.AssumeRoleWithWebIdentityRequest(&sts.AssumeRoleWithWebIdentityInput{
+		RoleArn:          aws.String(arn),
+		RoleSessionName:  aws.String("go-metadataproxy"),
+		WebIdentityToken: aws.String(strings.TrimSpace(string(token))),
+	})
+
+	resp, err := req.Send(tracer.ContextWithSpan(req.Context(), span))
+	if err != nil {
+		span.Finish(tracer.WithError(err))
+		return nil, err
+	}
+
+	assumedRole := &sts.AssumeRoleResponse{
+		AssumeRoleOutput: &sts.AssumeRoleOutput{
+			AssumedRoleUser: resp.AssumedRoleUser,
+			Credentials:     resp.Credentials,
+		},
+	}
+
+	ttl := credentialsTTL(*assumedRole.Credentials.Expiration)
+	request.log.Infof("Will cache STS Assumed Role With Web Identity info for %s in %s", arn, ttl.String())
+	permissionCache.Set(cacheKey, assumedRole, ttl)
+	return assumedRole, nil
+}
+
+// stsClientForRole returns the STS client that should be used to assume the role.
+//
+// The source credentials matching the role are used if configured, otherwise the host credentials.
+// When a broker role is configured for the account of the role (or globally), the broker role is assumed
+// first using the source credentials, and a STS client using the broker credentials is returned instead
+func stsClientForRole(roleArn string, request *Request, parentSpan tracer.Span) (*sts.Client, error) {
+	client := stsService
+	source := findSourceCredentials(roleArn)
+	if source != nil {
+		request.log.Infof("Using %s source credentials (%s) for %s", source.kind, source.pattern, roleArn)
+		request.setLabel("aws.source_credentials", source.kind)
+		client = source.client
+	}
+
+	broker := findBrokerRole(roleArn)
+	if broker == "" || broker == roleArn {
+		return client, nil
+	}
+
+	span := tracer.StartSpan("assumeBrokerRoleFromAWS", tracer.ChildOf(parentSpan.Context()))
+	defer span.Finish()
+	span.SetTag("aws.arn", broker)
+
+	request.setLabel("aws.role.broker", broker)
+
+	cacheKey := brokerCacheKey(source, broker)
+
+	request.log.Infof("Looking for STS broker role %s", broker)
+	if client, ok := brokerCache.Get(cacheKey); ok {
+		request.setLabel("aws.cache.broker_role", "hit")
+		request.log.Infof("Found STS broker role %s in cache", broker)
+		return client.(*sts.Client), nil
+	}
+
+	request.setLabel("aws.cache.broker_role", "miss")
+	request.log.Infof("Requesting STS broker role %s from AWS", broker)
+	req := client.AssumeRoleRequest(constructAssumeRoleInput(broker, ""))
+
+	assumedRole, err := req.Send(tracer.ContextWithSpan(req.Context(), span))
+	if err != nil {
+		span.Finish(tracer.WithError(err))
+		return nil, err
+	}
+
+	recordSTSSuccess(client)
+
+	cfg := awsConfig.Copy()
+	cfg.Credentials = aws.NewStaticCredentialsProvider(
+		*assumedRole.Credentials.AccessKeyId,
+		*assumedRole.Credentials.SecretAccessKey,
+		*assumedRole.Credentials.SessionToken,
+	)
+	brokerClient := sts.New(cfg)
+
+	ttl := credentialsTTL(*assumedRole.Credentials.Expiration)
+	request.log.Infof("Will cache STS broker role %s in %s", broker, ttl.String())
+	brokerCache.Set(cacheKey, brokerClient, ttl)
+	return brokerClient, nil
+}
+
+// brokerCacheKey returns the brokerCache key of the broker role, assumed with the source credentials (or the host
+// credentials when source is nil), as each source identity has its own broker session
+func brokerCacheKey(source *sourceCredentials, broker string) string {
+	if source == nil {
+		return "host:" + broker
+	}
+
+	return fmt.Sprintf("%s=%s:%s", source.pattern, source.kind, broker)
+}
+
+// findBrokerRole returns the broker role ARN to use for the role, or an empty string if none is configured
+func findBrokerRole(roleArn string) string {
+	if parsed, err := arn.Parse(roleArn); err == nil {
+		if broker, ok := brokerRoles[parsed.AccountID]; ok {
+			return broker
+		}
+	}
+
+	return brokerRole
+}
+
+// minCredentialsTTL is the shortest time credentials are cached for, as go-cache never expires entries with a
+// negative TTL (e.g. when ROLE_CACHE_OFFSET is longer than the lifetime of the credentials)
+const minCredentialsTTL = 1 * time.Minute
+
+// credentialsTTL returns how long the credentials can be cached, ROLE_CACHE_OFFSET before they expire
+func credentialsTTL(expiration time.Time) time.Duration {
+	remaining := time.Until(expiration)
+
+	ttl := remaining - getExpirationOffset()
+	if ttl < minCredentialsTTL {
+		ttl = minCredentialsTTL
+	}
+
+	// never cache the credentials beyond their expiration
+	if ttl > remaining {
+		ttl = remaining
+	}
+
+	if ttl <= 0 {
+		return time.Nanosecond
+	}
+
+	return ttl
+}
+
 func getExpirationOffset() time.Duration {
 	durStr := getenvDefault("ROLE_CACHE_OFFSET", "15m")
 	dur, err := time.ParseDuration(durStr)
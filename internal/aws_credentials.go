@@ -0,0 +1,160 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/arn"
+	"github.com/aws/aws-sdk-go-v2/aws/external"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+	log "github.com/sirupsen/logrus"
+)
+
+// sourceCredentials is the STS client used to assume roles matching the pattern
+type sourceCredentials struct {
+	lastSuccessTime int64 // first, for atomic access on 32-bit platforms
+	pattern         string
+	kind            string
+	client          *sts.Client
+}
+
+var (
+	sourceCredentialsList []*sourceCredentials
+)
+
+// configureSourceCredentials will setup the per-account source credentials from SOURCE_CREDENTIALS
+//
+// The format is a comma separated list of "pattern=kind:args" pairs, where pattern is either an
+// account ID or an IAM role ARN pattern (e.g. arn:aws:iam::*:role/ci-*), and kind is one of
+//
+//	profile:<name>
+//	web-identity:<token-file>:<role-arn>
+//	static:<access-key-id>:<secret-access-key>
+func configureSourceCredentials(cfg aws.Config) {
+	value := os.Getenv("SOURCE_CREDENTIALS")
+	if value == "" {
+		return
+	}
+
+	for _, pair := range strings.Split(value, ",") {
+		chunks := strings.SplitN(pair, "=", 2)
+		if len(chunks) != 2 {
+			log.Fatalf("Invalid value for SOURCE_CREDENTIALS: '%s' is not in pattern=kind:args format", pair)
+		}
+
+		pattern := strings.TrimSpace(chunks[0])
+		spec := strings.TrimSpace(chunks[1])
+
+		provider, err := newSourceCredentialsProvider(cfg, spec)
+		if err != nil {
+			log.Fatalf("Invalid value for SOURCE_CREDENTIALS: %s", err.Error())
+		}
+
+		sourceCfg := cfg.Copy()
+		sourceCfg.Credentials = provider
+
+		source := &sourceCredentials{
+			pattern: pattern,
+			kind:    strings.SplitN(spec, ":", 2)[0],
+			client:  sts.New(sourceCfg),
+		}
+
+		log.Infof("Using %s source credentials for roles matching %s", source.kind, source.pattern)
+		sourceCredentialsList = append(sourceCredentialsList, source)
+	}
+}
+
+func newSourceCredentialsProvider(cfg aws.Config, spec string) (aws.CredentialsProvider, error) {
+	chunks := strings.SplitN(spec, ":", 3)
+
+	switch chunks[0] {
+	case "profile":
+		if len(chunks) != 2 || chunks[1] == "" {
+			return nil, fmt.Errorf("'%s' must be in profile:<name> format", spec)
+		}
+
+		profileCfg, err := external.LoadDefaultAWSConfig(external.WithSharedConfigProfile(chunks[1]))
+		if err != nil {
+			return nil, fmt.Errorf("could not load profile '%s': %s", chunks[1], err.Error())
+		}
+
+		return profileCfg.Credentials, nil
+
+	case "web-identity":
+		if len(chunks) != 3 || !arn.IsARN(chunks[2]) {
+			return nil, fmt.Errorf("'%s' must be in web-identity:<token-file>:<role-arn> format", spec)
+		}
+
+		return newWebIdentityCredentialsProvider(cfg, chunks[2], chunks[1]), nil
+
+	case "static":
+		if len(chunks) != 3 {
+			return nil, fmt.Errorf("'%s' must be in static:<access-key-id>:<secret-access-key> format", spec)
+		}
+
+		return aws.NewStaticCredentialsProvider(chunks[1], chunks[2], ""), nil
+
+	default:
+		return nil, fmt.Errorf("unknown source credentials kind '%s' (profile, web-identity or static)", chunks[0])
+	}
+}
+
+// newWebIdentityCredentialsProvider returns a credentials provider assuming the role using the token in tokenFile,
+// re-reading the token every time the credentials needs to be refreshed
+func newWebIdentityCredentialsProvider(cfg aws.Config, roleArn, tokenFile string) aws.CredentialsProvider {
+	anonymousCfg := cfg.Copy()
+	anonymousCfg.Credentials = aws.AnonymousCredentials
+	client := sts.New(anonymousCfg)
+
+	return &aws.SafeCredentialsProvider{
+		RetrieveFn: func(ctx context.Context) (aws.Credentials, error) {
+			token, err := ioutil.ReadFile(tokenFile)
+			if err != nil {
+				return aws.Credentials{}, err
+			}
+
+			req := client.AssumeRoleWithWebIdentityRequest(&sts.AssumeRoleWithWebIdentityInput{
+				RoleArn:          aws.String(roleArn),
+				RoleSessionName:  aws.String("go-metadataproxy"),
+				WebIdentityToken: aws.String(strings.TrimSpace(string(token))),
+			})
+
+			resp, err := req.Send(ctx)
+			if err != nil {
+				return aws.Credentials{}, err
+			}
+
+			return aws.Credentials{
+				AccessKeyID:     *resp.Credentials.AccessKeyId,
+				SecretAccessKey: *resp.Credentials.SecretAccessKey,
+				SessionToken:    *resp.Credentials.SessionToken,
+				Source:          "WebIdentityCredentials",
+				CanExpire:       true,
+				Expires:         resp.Credentials.Expiration.Add(-5 * time.Minute),
+			}, nil
+		},
+	}
+}
+
+// findSourceCredentials returns the first source credentials matching the account or ARN of the role, if any
+func findSourceCredentials(roleArn string) *sourceCredentials {
+	parsed, err := arn.Parse(roleArn)
+
+	for _, source := range sourceCredentialsList {
+		if err == nil && source.pattern == parsed.AccountID {
+			return source
+		}
+
+		if ok, _ := path.Match(source.pattern, roleArn); ok {
+			return source
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,195 @@
+package internal
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/defaults"
+	"github.com/aws/aws-sdk-go-v2/aws/endpoints"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+)
+
+func TestCredentialsTTL(t *testing.T) {
+	tests := []struct {
+		name      string
+		offset    string
+		remaining time.Duration
+		min       time.Duration
+		max       time.Duration
+	}{
+		{name: "default offset", offset: "15m", remaining: time.Hour, min: 44 * time.Minute, max: 45 * time.Minute},
+		{name: "offset longer than the lifetime", offset: "2h", remaining: time.Hour, min: minCredentialsTTL, max: minCredentialsTTL},
+		{name: "offset equal to the lifetime", offset: "1h", remaining: time.Hour, min: minCredentialsTTL, max: minCredentialsTTL},
+		{name: "expiring before the minimum", offset: "15m", remaining: 30 * time.Second, min: 29 * time.Second, max: 30 * time.Second},
+		{name: "expired", offset: "15m", remaining: -time.Minute, min: time.Nanosecond, max: time.Nanosecond},
+	}
+
+	defer os.Unsetenv("ROLE_CACHE_OFFSET")
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			os.Setenv("ROLE_CACHE_OFFSET", tt.offset)
+
+			ttl := credentialsTTL(time.Now().Add(tt.remaining))
+			if ttl < tt.min || ttl > tt.max {
+				t.Errorf("expected a TTL between %s and %s, got %s", tt.min, tt.max, ttl)
+			}
+		})
+	}
+}
+
+// newFakeSTSConfig returns the config of a STS endpoint answering GetCallerIdentity and AssumeRole, or AccessDenied
+// when denied
+func newFakeSTSConfig(t *testing.T, denied bool, calls *int) aws.Config {
+	t.Helper()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*calls++
+
+		w.Header().Set("Content-Type", "text/xml")
+		if denied {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`<ErrorResponse><Error><Type>Sender</Type><Code>AccessDenied</Code><Message>denied</Message></Error></ErrorResponse>`))
+			return
+		}
+
+		if r.FormValue("Action") == "AssumeRole" {
+			fmt.Fprintf(w, `<AssumeRoleResponse><AssumeRoleResult><Credentials><AccessKeyId>ASIA%d</AccessKeyId><SecretAccessKey>secret</SecretAccessKey><SessionToken>token</SessionToken><Expiration>%s</Expiration></Credentials><AssumedRoleUser><Arn>%s</Arn><AssumedRoleId>AROAEXAMPLE:go-metadataproxy</AssumedRoleId></AssumedRoleUser></AssumeRoleResult></AssumeRoleResponse>`,
+				*calls, time.Now().Add(time.Hour).UTC().Format(awsTimeLayoutResponse), r.FormValue("RoleArn"))
+			return
+		}
+
+		w.Write([]byte(`<GetCallerIdentityResponse><GetCallerIdentityResult><Account>012345678910</Account></GetCallerIdentityResult></GetCallerIdentityResponse>`))
+	}))
+	t.Cleanup(server.Close)
+
+	cfg := defaults.Config()
+	cfg.Region = "us-east-1"
+	cfg.Credentials = aws.NewStaticCredentialsProvider("AKIAEXAMPLE", "secret", "")
+	cfg.EndpointResolver = aws.ResolveWithEndpointURL(server.URL)
+	cfg.Retryer = aws.NoOpRetryer{}
+
+	return cfg
+}
+
+// newFakeSTSClient returns a STS client for a fake STS endpoint, see newFakeSTSConfig
+func newFakeSTSClient(t *testing.T, denied bool, calls *int) *sts.Client {
+	return sts.New(newFakeSTSConfig(t, denied, calls))
+}
+
+func TestStsClientForRole(t *testing.T) {
+	defer func(cfg aws.Config, client *sts.Client, sources []*sourceCredentials, broker string, brokers map[string]string) {
+		awsConfig, stsService, sourceCredentialsList, brokerRole, brokerRoles = cfg, client, sources, broker, brokers
+	}(awsConfig, stsService, sourceCredentialsList, brokerRole, brokerRoles)
+
+	var hostCalls, labCalls, ciCalls, brokerCalls int
+	awsConfig = newFakeSTSConfig(t, false, &brokerCalls)
+	stsService = newFakeSTSClient(t, false, &hostCalls)
+	lab := &sourceCredentials{pattern: "111111111111", kind: "profile", client: newFakeSTSClient(t, false, &labCalls)}
+	ci := &sourceCredentials{pattern: "arn:aws:iam::*:role/ci-*", kind: "web-identity", client: newFakeSTSClient(t, false, &ciCalls)}
+	sourceCredentialsList = []*sourceCredentials{lab, ci}
+	brokerRole, brokerRoles = "arn:aws:iam::999999999999:role/broker", map[string]string{}
+
+	brokerCache.Flush()
+	defer brokerCache.Flush()
+
+	request := NewRequest(httptest.NewRequest(http.MethodGet, "/latest/meta-data/iam/security-credentials/", nil), "test", "/test")
+
+	tests := []struct {
+		name           string
+		role           string
+		expectedClient *sts.Client
+		expectedCalls  [3]int // host, lab and ci calls after the request
+	}{
+		{name: "host credentials assume the broker", role: "arn:aws:iam::222222222222:role/web", expectedCalls: [3]int{1, 0, 0}},
+		{name: "host broker session is cached", role: "arn:aws:iam::222222222222:role/worker", expectedCalls: [3]int{1, 0, 0}},
+		{name: "source credentials get their own broker session", role: "arn:aws:iam::111111111111:role/web", expectedCalls: [3]int{1, 1, 0}},
+		{name: "source broker session is cached", role: "arn:aws:iam::111111111111:role/worker", expectedCalls: [3]int{1, 1, 0}},
+		{name: "other source credentials get their own broker session", role: "arn:aws:iam::222222222222:role/ci-deploy", expectedCalls: [3]int{1, 1, 1}},
+		{name: "the broker role is not chained", role: "arn:aws:iam::999999999999:role/broker", expectedClient: stsService, expectedCalls: [3]int{1, 1, 1}},
+	}
+
+	clients := make(map[*sts.Client]bool)
+	for _, tt := range tests {
+		client, err := stsClientForRole(tt.role, request, request.datadogSpan)
+		if err != nil {
+			t.Fatalf("%s: %s", tt.name, err)
+		}
+
+		if tt.expectedClient != nil && client != tt.expectedClient {
+			t.Errorf("%s: expected the client of the credentials, got a broker client", tt.name)
+		}
+
+		if calls := [3]int{hostCalls, labCalls, ciCalls}; calls != tt.expectedCalls {
+			t.Errorf("%s: expected %v calls, got %v", tt.name, tt.expectedCalls, calls)
+		}
+
+		clients[client] = true
+	}
+
+	// a broker session per source credentials (host, lab and ci), and the host client for the broker role
+	if len(clients) != 4 {
+		t.Errorf("expected 4 different clients, got %d", len(clients))
+	}
+
+	if brokerCalls != 0 {
+		t.Errorf("expected the broker clients not to be used yet, got %d calls", brokerCalls)
+	}
+}
+
+func TestReadRoleLocally(t *testing.T) {
+	defer func(partition endpoints.Partition) { awsPartition = partition }(awsPartition)
+
+	tests := []struct {
+		partition string
+		role      string
+		expected  string
+	}{
+		{partition: "aws", role: "app", expected: "arn:aws:iam::000000000000:role/app"},
+		{partition: "aws-cn", role: "app", expected: "arn:aws-cn:iam::000000000000:role/app"},
+		{partition: "aws-us-gov", role: "/path/app", expected: "arn:aws-us-gov:iam::000000000000:role/path/app"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.partition, func(t *testing.T) {
+			awsPartition, _ = endpoints.NewDefaultResolver().Partitions().ForPartition(tt.partition)
+
+			role := readRoleLocally(tt.role)
+			if *role.Arn != tt.expected {
+				t.Errorf("expected %s, got %s", tt.expected, *role.Arn)
+			}
+		})
+	}
+}
+
+func TestFindPartition(t *testing.T) {
+	tests := []struct {
+		name      string
+		partition string
+		region    string
+		expected  string
+	}{
+		{name: "commercial region", region: "eu-west-1", expected: "aws"},
+		{name: "china region", region: "cn-north-1", expected: "aws-cn"},
+		{name: "govcloud region", region: "us-gov-west-1", expected: "aws-us-gov"},
+		{name: "no region", region: "", expected: "aws"},
+		{name: "explicit partition", partition: "aws-cn", region: "eu-west-1", expected: "aws-cn"},
+	}
+
+	defer os.Unsetenv("AWS_PARTITION")
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			os.Setenv("AWS_PARTITION", tt.partition)
+
+			if partition := findPartition(tt.region); partition.ID() != tt.expected {
+				t.Errorf("expected %s, got %s", tt.expected, partition.ID())
+			}
+		})
+	}
+}
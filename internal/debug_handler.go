@@ -0,0 +1,324 @@
+package internal
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+	docker "github.com/fsouza/go-dockerclient"
+)
+
+// debugContainer is how go-metadataproxy sees a running container (without any secrets)
+type debugContainer struct {
+	ID          string            `json:"id"`
+	Name        string            `json:"name"`
+	Image       string            `json:"image"`
+	Networks    []*debugNetwork   `json:"networks"`
+	Role        string            `json:"role,omitempty"`
+	RoleSource  string            `json:"role_source,omitempty"`
+	RoleARN     string            `json:"role_arn,omitempty"`
+	RoleError   string            `json:"role_error,omitempty"`
+	ExternalID  bool              `json:"external_id"`
+	WebIdentity bool              `json:"web_identity"`
+	Credentials *debugCredentials `json:"credentials,omitempty"`
+}
+
+type debugNetwork struct {
+	Name      string `json:"name"`
+	ID        string `json:"id"`
+	IPAddress string `json:"ip_address"`
+	Trusted   bool   `json:"trusted"`
+}
+
+type debugCredentials struct {
+	Cached          bool   `json:"cached"`
+	Expiration      string `json:"expiration,omitempty"`
+	CacheExpiration string `json:"cache_expiration,omitempty"`
+}
+
+// debugStep is a single step of resolving the role of an IP
+type debugStep struct {
+	Step    string `json:"step"`
+	Result  string `json:"result"`
+	Details string `json:"details"`
+}
+
+// handles: GET /admin/containers
+// handles: GET /admin/containers?ip={ip}
+func debugContainersHandler(w http.ResponseWriter, r *http.Request) {
+	request := NewRequest(r, "admin-containers", "/admin/containers")
+	request.log.Infof("Handling %s %s from %s", r.Method, r.URL.String(), remoteIP(r.RemoteAddr))
+	request.jsonErrors = true
+	defer request.incrCounterWithLabels([]string{"http_request"}, 1)
+
+	// publish specific go-metadataproxy headers
+	request.setResponseHeaders(w)
+
+	if r.Method != http.MethodGet {
+		request.HandleError(fmt.Errorf("Method %s is not allowed", r.Method), errorKindMethodNotAllowed, "method_not_allowed", w)
+		return
+	}
+
+	if ip := r.URL.Query().Get("ip"); ip != "" {
+		request.setLabel("response_code", "200")
+		sendJSONResponse(w, map[string]interface{}{
+			"ip":    ip,
+			"steps": explainRoleResolution(ip, request),
+		})
+		return
+	}
+
+	containers, err := dockerClient.ListContainers(docker.ListContainersOptions{
+		Filters: map[string][]string{"status": {"running"}},
+	})
+	if err != nil {
+		request.HandleError(err, errorKindInternal, "could_not_list_containers", w)
+		return
+	}
+
+	response := make([]*debugContainer, 0, len(containers))
+	for _, listed := range containers {
+		container, err := dockerClient.InspectContainer(listed.ID)
+		if err != nil {
+			request.log.Warnf("Could not inspect container %s: %s", listed.ID, err.Error())
+			continue
+		}
+
+		response = append(response, describeContainer(listed, container, request))
+	}
+
+	request.setLabel("response_code", "200")
+	sendJSONResponse(w, response)
+}
+
+// describeContainer returns the networks, role and credential state of the container
+func describeContainer(listed docker.APIContainers, container *docker.Container, request *Request) *debugContainer {
+	result := &debugContainer{
+		ID:          container.ID,
+		Name:        strings.TrimPrefix(container.Name, "/"),
+		Image:       listed.Image,
+		Networks:    make([]*debugNetwork, 0),
+		WebIdentity: findDockerContainerWebIdentityTokenFile(container) != "",
+	}
+
+	for name, network := range listed.Networks.Networks {
+		trusted, _ := isTrustedNetwork(containerMatch{container: listed, network: name, networkID: network.NetworkID})
+		result.Networks = append(result.Networks, &debugNetwork{Name: name, ID: network.NetworkID, IPAddress: network.IPAddress, Trusted: trusted})
+	}
+	sort.Slice(result.Networks, func(i, j int) bool { return result.Networks[i].Name < result.Networks[j].Name })
+
+	if externalID, ok := findDockerContainerEnvValue(container, "IAM_EXTERNAL_ID"); ok && externalID != "" {
+		result.ExternalID = true
+	}
+
+	result.Role, result.RoleSource = findDebugContainerRole(container)
+	if result.Role == "" {
+		return result
+	}
+
+	role, err := readRoleFromAWS(result.Role, request, request.datadogSpan)
+	if err != nil {
+		result.RoleError = err.Error()
+		return result
+	}
+
+	result.RoleARN = *role.Arn
+	result.Credentials = describeCachedCredentials(container, result.RoleARN)
+	return result
+}
+
+// findDebugContainerRole returns the role of the container, and where it was configured
+func findDebugContainerRole(container *docker.Container) (string, string) {
+	if role, ok := findDockerContainerEnvValue(container, "IAM_ROLE"); ok {
+		return role, "IAM_ROLE"
+	}
+
+	if defaultRole != "" {
+		return defaultRole, "DEFAULT_ROLE"
+	}
+
+	return "", ""
+}
+
+// credentialsCacheKey returns the permissionCache key of the credentials served to the container
+func credentialsCacheKey(container *docker.Container, roleARN string) string {
+	if !isLocalMode && findDockerContainerWebIdentityTokenFile(container) != "" {
+		return webIdentityCacheKey(container.ID, roleARN)
+	}
+
+	return roleARN
+}
+
+// describeCachedCredentials returns the expiration of the cached credentials of the container role
+func describeCachedCredentials(container *docker.Container, roleARN string) *debugCredentials {
+	cached, cacheExpiration, ok := permissionCache.GetWithExpiration(credentialsCacheKey(container, roleARN))
+	if !ok {
+		return &debugCredentials{Cached: false}
+	}
+
+	result := &debugCredentials{Cached: true, CacheExpiration: cacheExpiration.UTC().Format(awsTimeLayoutResponse)}
+	if assumedRole, ok := cached.(*sts.AssumeRoleResponse); ok && assumedRole.Credentials.Expiration != nil {
+		result.Expiration = assumedRole.Credentials.Expiration.UTC().Format(awsTimeLayoutResponse)
+	}
+
+	return result
+}
+
+// findIssuedCredential returns the container the cached credentials of the role were first issued to, if any
+func findIssuedCredential(container *docker.Container, roleARN string) *issuedCredential {
+	cached, ok := permissionCache.Get(credentialsCacheKey(container, roleARN))
+	if !ok {
+		return nil
+	}
+
+	assumedRole, ok := cached.(*sts.AssumeRoleResponse)
+	if !ok || assumedRole.Credentials.AccessKeyId == nil {
+		return nil
+	}
+
+	issued, ok := issuedCredentials.Get(*assumedRole.Credentials.AccessKeyId)
+	if !ok {
+		return nil
+	}
+
+	return issued.(*issuedCredential)
+}
+
+// explainRoleResolution resolves the role of the IP the way findAWSRoleInformation would, describing each step
+func explainRoleResolution(ip string, request *Request) []*debugStep {
+	steps := make([]*debugStep, 0)
+	add := func(step, result, format string, args ...interface{}) {
+		steps = append(steps, &debugStep{Step: step, Result: result, Details: fmt.Sprintf(format, args...)})
+	}
+
+	if !isAllowedSourceIP(ip, imdsAllowedCIDRs) {
+		add("access_control", "fail", "%s is not in IMDS_ALLOWED_CIDRS, requests are denied", ip)
+		return steps
+	}
+	add("access_control", "ok", "%s is allowed to use the metadata routes", ip)
+
+	containers, err := dockerClient.ListContainers(docker.ListContainersOptions{
+		Filters: map[string][]string{"status": {"running"}},
+	})
+	if err != nil {
+		add("list_containers", "fail", "Could not list the running containers: %s", err.Error())
+		return steps
+	}
+
+	matches := findContainerMatches(ip, containers)
+	if len(matches) == 0 {
+		add("match_ip", "fail", "None of the %d running containers have the IP %s, credential requests get a 404", len(containers), ip)
+		return steps
+	}
+	add("match_ip", "ok", "Found %s", describeMatches(matches))
+
+	matches, err = filterTrustedMatches(ip, matches)
+	if err != nil {
+		add("trusted_networks", "fail", "%s (UNTRUSTED_NETWORK_MODE=%s)", err.Error(), untrustedNetworkMode)
+		return steps
+	}
+	if len(trustedNetworks) == 0 {
+		add("trusted_networks", "skip", "TRUSTED_NETWORKS is not configured, all networks are trusted")
+	} else {
+		add("trusted_networks", "ok", "Trusted: %s", describeMatches(matches))
+	}
+
+	// without a request from the IP, the ingress interface can only be derived from the host subnets
+	matches, err = filterIngressMatches(ip, nil, matches, request)
+	if err != nil {
+		add("ingress_interface", "fail", "%s", err.Error())
+		return steps
+	}
+	if ingress, _ := findIngressInterface(ip, nil); ingress != "" && !isIngressVerificationSkipped {
+		add("ingress_interface", "ok", "Requests from %s arrive on %s, matching %s", ip, ingress, describeMatches(matches))
+	} else {
+		add("ingress_interface", "skip", "The ingress interface is not verified")
+	}
+
+	if len(matches) > 1 {
+		add("ambiguity", "fail", "%d containers match %s, requests are denied rather than guessing", len(matches), ip)
+		return steps
+	}
+	add("ambiguity", "ok", "Only %s matches", describeMatches(matches))
+
+	container, err := dockerClient.InspectContainer(matches[0].container.ID)
+	if err != nil {
+		add("inspect_container", "fail", "Could not inspect container %s: %s", matches[0].container.ID, err.Error())
+		return steps
+	}
+	add("inspect_container", "ok", "Container %s (%s) is running image %s", strings.TrimPrefix(container.Name, "/"), container.ID, container.Config.Image)
+
+	role, source := findDebugContainerRole(container)
+	switch source {
+	case "IAM_ROLE":
+		add("find_role", "ok", "IAM_ROLE of the container is %s", role)
+	case "DEFAULT_ROLE":
+		add("find_role", "ok", "The container has no IAM_ROLE, falling back to DEFAULT_ROLE %s", role)
+	default:
+		add("find_role", "fail", "The container has no IAM_ROLE and DEFAULT_ROLE is not configured, credential requests get a 404")
+		return steps
+	}
+
+	roleInfo, err := readRoleFromAWS(role, request, request.datadogSpan)
+	if err != nil {
+		add("resolve_role", "fail", "Could not resolve %s: %s", role, err.Error())
+		return steps
+	}
+	add("resolve_role", "ok", "%s resolves to %s", role, *roleInfo.Arn)
+
+	switch {
+	case isLocalMode:
+		add("credentials_source", "ok", "Local mode, credentials are generated (LOCAL_CREDENTIALS=%s)", localCredentials)
+	case findDockerContainerWebIdentityTokenFile(container) != "":
+		add("credentials_source", "ok", "AssumeRoleWithWebIdentity using the token file %s of the container", findDockerContainerWebIdentityTokenFile(container))
+	default:
+		details := "AssumeRole using the go-metadataproxy credentials"
+		if source := findSourceCredentials(*roleInfo.Arn); source != nil {
+			details = fmt.Sprintf("AssumeRole using the %s source credentials (%s)", source.kind, source.pattern)
+		}
+
+		if broker := findBrokerRole(*roleInfo.Arn); broker != "" && broker != *roleInfo.Arn {
+			details += fmt.Sprintf(", through the broker role %s", broker)
+		}
+
+		add("credentials_source", "ok", "%s", details)
+	}
+
+	if externalID, ok := findDockerContainerEnvValue(container, "IAM_EXTERNAL_ID"); ok && externalID != "" {
+		add("external_id", "ok", "IAM_EXTERNAL_ID is set")
+	} else {
+		add("external_id", "skip", "IAM_EXTERNAL_ID is not set")
+	}
+
+	if credentials := describeCachedCredentials(container, *roleInfo.Arn); credentials.Cached {
+		add("credentials_cache", "ok", "Cached credentials expire at %s, and are cached until %s", credentials.Expiration, credentials.CacheExpiration)
+	} else {
+		add("credentials_cache", "ok", "No cached credentials, the next request assumes the role")
+	}
+
+	if isAnomalyDetectionEnabled {
+		if issued := findIssuedCredential(container, *roleInfo.Arn); issued == nil {
+			add("anomaly_detection", "ok", "The cached credentials have not been issued to a container yet")
+		} else if isSharedRole(*roleInfo.Arn) {
+			add("anomaly_detection", "ok", "The credentials were first issued to container %s (image %s), and the role is shared between images", issued.containerID, issued.containerImage)
+		} else if issued.containerID != container.ID && issued.containerImage != container.Config.Image {
+			add("anomaly_detection", "fail", "The credentials were first issued to container %s (image %s), requests are flagged as credentials_shared_across_images (ANOMALY_MODE=%s)", issued.containerID, issued.containerImage, anomalyMode)
+		} else {
+			add("anomaly_detection", "ok", "The credentials were first issued to container %s (image %s)", issued.containerID, issued.containerImage)
+		}
+	}
+
+	return steps
+}
+
+// describeMatches returns a human readable list of the containers and networks
+func describeMatches(matches []containerMatch) string {
+	result := make([]string, 0, len(matches))
+	for _, match := range matches {
+		result = append(result, fmt.Sprintf("%s (network '%s')", strings.Join(match.container.Names, ","), match.network))
+	}
+
+	return strings.Join(result, ", ")
+}
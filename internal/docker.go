@@ -1,9 +1,16 @@
 package internal
 
 import (
+	"archive/tar"
+	"bytes"
+	"crypto/subtle"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"os"
+	"path/filepath"
 	"strings"
+	"time"
 
 	docker "github.com/fsouza/go-dockerclient"
 	log "github.com/sirupsen/logrus"
@@ -17,6 +24,11 @@ var (
 	copyDockerEnvs     = strings.Split(os.Getenv("COPY_DOCKER_ENV"), ",")
 	copyRequestHeaders = strings.Split(os.Getenv("COPY_REQUEST_HEADERS"), ",")
 	labelSeparator     = getenvDefault("LABEL_SEPARATOR", "_")
+	webIdentityLabel   = getenvDefault("WEB_IDENTITY_TOKEN_LABEL", "IAM_WEB_IDENTITY_TOKEN_FILE")
+	hostFilesystemRoot = os.Getenv("HOST_FS_ROOT")
+
+	isECSCredentialsEnabled             = os.Getenv("ENABLE_ECS_CREDENTIALS") != ""
+	isECSCredentialsAuthorizationForced = os.Getenv("ECS_CREDENTIALS_REQUIRE_AUTHORIZATION") != ""
 )
 
 // ConfigureDocker will setup a docker client used during normal operations
@@ -35,6 +47,8 @@ func ConfigureDocker() {
 
 	log.Infof("Connected to Docker daemon: %s @ %s", info.Name, info.ServerVersion)
 	dockerClient = client
+
+	configureTrustedNetworks()
 }
 
 func findDockerContainer(ip string, request *Request, parentSpan tracer.Span) (*docker.Container, error) {
@@ -44,7 +58,9 @@ func findDockerContainer(ip string, request *Request, parentSpan tracer.Span) (*
 
 	var container *docker.Container
 	request.log.Infof("Looking up container info for %s in docker", ip)
-	containers, err := dockerClient.ListContainers(docker.ListContainersOptions{All: true})
+	containers, err := dockerClient.ListContainers(docker.ListContainersOptions{
+		Filters: map[string][]string{"status": {"running"}},
+	})
 	if err != nil {
 		span.Finish(tracer.WithError(err))
 		return nil, err
@@ -73,6 +89,7 @@ func findDockerContainer(ip string, request *Request, parentSpan tracer.Span) (*
 		}
 	}
 
+	request.container = container
 	request.setLogLabel(labelName("container", "id"), container.ID)
 	request.setTraceTag(labelName("container", "id"), container.ID)
 
@@ -88,25 +105,57 @@ func findContainerByIP(ip string, request *Request, containers []docker.APIConta
 	defer span.Finish()
 	span.SetTag("docker.ip", ip)
 
-	for _, container := range containers {
-		for name, network := range container.Networks.Networks {
-			if network.IPAddress == ip {
-				request.log.Infof("Found container IP '%s' in %+v within network '%s'", ip, container.Names, name)
+	matches := findContainerMatches(ip, containers)
+	if len(matches) == 0 {
+		err := notFoundErrorf("Could not find any container with IP %s", ip)
+		span.Finish(tracer.WithError(err))
+		return nil, err
+	}
 
-				inspectedContainer, err := dockerClient.InspectContainer(container.ID)
-				if err != nil {
-					span.Finish(tracer.WithError(err))
-					return nil, err
-				}
+	// only identify callers on trusted networks
+	matches, err := filterTrustedMatches(ip, matches)
+	if err != nil {
+		span.Finish(tracer.WithError(err))
+		return nil, err
+	}
 
-				return inspectedContainer, nil
-			}
+	// overlapping subnets can give several matches, keep the one on the network the request arrived on
+	matches, err = filterIngressMatches(ip, localAddr(request.request), matches, request)
+	if err != nil {
+		span.Finish(tracer.WithError(err))
+		return nil, err
+	}
+
+	// never guess which container the request came from
+	if len(matches) > 1 {
+		names := make([]string, 0, len(matches))
+		for _, match := range matches {
+			names = append(names, fmt.Sprintf("%v (network '%s')", match.container.Names, match.network))
 		}
+
+		err := forbiddenErrorf("Found %d containers with IP %s: %s", len(matches), ip, strings.Join(names, ", "))
+		span.Finish(tracer.WithError(err))
+		return nil, err
+	}
+
+	match := matches[0]
+	request.log.Infof("Found container IP '%s' in %+v within network '%s'", ip, match.container.Names, match.network)
+	request.setLabel(labelName("container", "network"), match.network)
+
+	inspectedContainer, err := dockerClient.InspectContainer(match.container.ID)
+	if err != nil {
+		span.Finish(tracer.WithError(err))
+		return nil, err
+	}
+
+	// the container could have stopped (and its IP been reused) since it was listed
+	if !inspectedContainer.State.Running {
+		err := notFoundErrorf("Container %s with IP %s is no longer running", inspectedContainer.ID, ip)
+		span.Finish(tracer.WithError(err))
+		return nil, err
 	}
 
-	err := fmt.Errorf("Could not find any container with IP %s", ip)
-	span.Finish(tracer.WithError(err))
-	return nil, err
+	return inspectedContainer, nil
 }
 
 func findDockerContainerIAMRole(container *docker.Container, request *Request) (string, error) {
@@ -119,7 +168,7 @@ func findDockerContainerIAMRole(container *docker.Container, request *Request) (
 		return defaultRole, nil
 	}
 
-	return "", fmt.Errorf("Could not find IAM_ROLE in the container ENV config")
+	return "", notFoundErrorf("Could not find IAM_ROLE in the container ENV config")
 }
 
 func findDockerContainerexternalID(container *docker.Container, request *Request) string {
@@ -127,6 +176,126 @@ func findDockerContainerexternalID(container *docker.Container, request *Request
 	return v
 }
 
+// findDockerContainerWebIdentityTokenFile returns the path (inside the container) of the web identity token
+// file from the container label, or an empty string if the container does not use web identity
+func findDockerContainerWebIdentityTokenFile(container *docker.Container) string {
+	if container == nil || container.Config == nil {
+		return ""
+	}
+
+	return container.Config.Labels[webIdentityLabel]
+}
+
+// findDockerContainerMount returns the mount with the most specific destination containing the file, and the path of
+// the file relative to the mount
+func findDockerContainerMount(container *docker.Container, file string) (docker.Mount, string, bool) {
+	var result docker.Mount
+	var resultRel string
+	found := false
+
+	for _, mount := range container.Mounts {
+		rel, err := filepath.Rel(mount.Destination, file)
+		if err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+			continue
+		}
+
+		if !found || len(filepath.Clean(mount.Destination)) > len(filepath.Clean(result.Destination)) {
+			result, resultRel, found = mount, rel, true
+		}
+	}
+
+	return result, resultRel, found
+}
+
+// readDockerMountFile reads the file relative to the host path of a mount
+//
+// Symlinks are resolved on the host, so the resolved file must stay within the mount, otherwise a container could
+// symlink any host file into its mount and have it read with the privileges of go-metadataproxy
+func readDockerMountFile(source, rel string) ([]byte, error) {
+	root, err := filepath.EvalSymlinks(source)
+	if err != nil {
+		return nil, err
+	}
+
+	resolved, err := filepath.EvalSymlinks(filepath.Join(root, rel))
+	if err != nil {
+		return nil, err
+	}
+
+	if inside, err := filepath.Rel(root, resolved); err != nil || inside == ".." || strings.HasPrefix(inside, "../") {
+		return nil, forbiddenErrorf("%s resolves outside of the container mount", rel)
+	}
+
+	info, err := os.Stat(resolved)
+	if err != nil {
+		return nil, err
+	}
+
+	if !info.Mode().IsRegular() {
+		return nil, forbiddenErrorf("%s is not a regular file", rel)
+	}
+
+	return ioutil.ReadFile(resolved)
+}
+
+// readDockerContainerFile reads a file from the container filesystem.
+//
+// If the file is within a mount of the container, it's read directly from the host path (prefixed with
+// HOST_FS_ROOT when go-metadataproxy itself is running in a container), otherwise it's read through the
+// Docker archive API
+func readDockerContainerFile(container *docker.Container, file string) ([]byte, error) {
+	file = filepath.Clean(file)
+
+	if mount, rel, ok := findDockerContainerMount(container, file); ok {
+		return readDockerMountFile(filepath.Join(hostFilesystemRoot, mount.Source), rel)
+	}
+
+	var buf bytes.Buffer
+	err := dockerClient.DownloadFromContainer(container.ID, docker.DownloadFromContainerOptions{
+		Path:              file,
+		OutputStream:      &buf,
+		InactivityTimeout: 5 * time.Second,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	archive := tar.NewReader(&buf)
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			return nil, fmt.Errorf("Could not find %s in container %s", file, container.ID)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if header.Typeflag == tar.TypeReg {
+			return ioutil.ReadAll(archive)
+		}
+	}
+}
+
+// verifyECSAuthorization verifies the Authorization header matches the AWS_CONTAINER_AUTHORIZATION_TOKEN of the container
+//
+// Containers without a token are allowed, unless ECS_CREDENTIALS_REQUIRE_AUTHORIZATION is set
+func verifyECSAuthorization(container *docker.Container, authorization string) error {
+	token, ok := findDockerContainerEnvValue(container, "AWS_CONTAINER_AUTHORIZATION_TOKEN")
+	if !ok || token == "" {
+		if isECSCredentialsAuthorizationForced {
+			return fmt.Errorf("Container has no AWS_CONTAINER_AUTHORIZATION_TOKEN, but authorization is required")
+		}
+
+		return nil
+	}
+
+	if subtle.ConstantTimeCompare([]byte(token), []byte(authorization)) != 1 {
+		return fmt.Errorf("Authorization header does not match the container AWS_CONTAINER_AUTHORIZATION_TOKEN")
+	}
+
+	return nil
+}
+
 func findDockerContainerEnvValue(container *docker.Container, key string) (string, bool) {
 	for _, envPair := range container.Config.Env {
 		chunks := strings.SplitN(envPair, "=", 2)
@@ -151,3 +320,23 @@ func getenvDefault(key, defaultValue string) string {
 
 	return value
 }
+
+func getenvMap(key string) map[string]string {
+	result := make(map[string]string)
+
+	value := os.Getenv(key)
+	if value == "" {
+		return result
+	}
+
+	for _, pair := range strings.Split(value, ",") {
+		chunks := strings.SplitN(pair, "=", 2)
+		if len(chunks) != 2 {
+			log.Fatalf("Invalid value for %s: '%s' is not in key=value format", key, pair)
+		}
+
+		result[strings.TrimSpace(chunks[0])] = strings.TrimSpace(chunks[1])
+	}
+
+	return result
+}
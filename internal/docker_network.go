@@ -0,0 +1,330 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	docker "github.com/fsouza/go-dockerclient"
+	"github.com/patrickmn/go-cache"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	isIngressVerificationSkipped = os.Getenv("SKIP_INGRESS_VERIFICATION") != ""
+	dockerNetworkCache           = cache.New(5*time.Minute, 10*time.Minute)
+	trustedNetworks              = parseTrustedNetworks(os.Getenv("TRUSTED_NETWORKS"))
+	untrustedNetworkMode         = getenvDefault("UNTRUSTED_NETWORK_MODE", "deny")
+
+	// errUntrustedNetwork is returned when the caller is only found on untrusted networks
+	errUntrustedNetwork = errors.New("untrusted network")
+)
+
+// containerMatch is a running container with the source IP in one of its networks
+type containerMatch struct {
+	container docker.APIContainers
+	network   string
+	networkID string
+}
+
+// findContainerMatches returns the networks of running containers with the IP
+func findContainerMatches(ip string, containers []docker.APIContainers) []containerMatch {
+	var matches []containerMatch
+	for _, container := range containers {
+		if container.State != "" && container.State != "running" {
+			continue
+		}
+
+		for name, network := range container.Networks.Networks {
+			if network.IPAddress == ip {
+				matches = append(matches, containerMatch{container: container, network: name, networkID: network.NetworkID})
+			}
+		}
+	}
+
+	return matches
+}
+
+// parseTrustedNetworks splits the comma separated list of network names, IDs and drivers (driver:<name>)
+func parseTrustedNetworks(value string) []string {
+	var result []string
+	for _, entry := range strings.Split(value, ",") {
+		if entry = strings.TrimSpace(entry); entry != "" {
+			result = append(result, entry)
+		}
+	}
+
+	return result
+}
+
+// configureTrustedNetworks will validate the trusted network settings
+func configureTrustedNetworks() {
+	switch untrustedNetworkMode {
+	case "deny", "passthrough":
+	default:
+		log.Fatalf("Invalid value for UNTRUSTED_NETWORK_MODE: %s (deny or passthrough)", untrustedNetworkMode)
+	}
+
+	if len(trustedNetworks) > 0 {
+		log.Infof("Identifying callers on the trusted networks %s (others: %s)", strings.Join(trustedNetworks, ", "), untrustedNetworkMode)
+	}
+}
+
+// isTrustedNetwork checks the network name, ID (or ID prefix) and driver against TRUSTED_NETWORKS
+func isTrustedNetwork(match containerMatch) (bool, error) {
+	if len(trustedNetworks) == 0 {
+		return true, nil
+	}
+
+	for _, entry := range trustedNetworks {
+		if driver := strings.TrimPrefix(entry, "driver:"); driver != entry {
+			network, err := findDockerNetwork(match.networkID)
+			if err != nil {
+				return false, err
+			}
+
+			if network.Driver == driver {
+				return true, nil
+			}
+
+			continue
+		}
+
+		if entry == match.network || entry == match.networkID || (len(entry) >= 12 && strings.HasPrefix(match.networkID, entry)) {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// filterTrustedMatches keeps the matches on trusted networks
+//
+// When the caller is only found on untrusted networks, the request is either denied (403) or served as if the caller
+// is not a container (passthrough only), depending on UNTRUSTED_NETWORK_MODE
+func filterTrustedMatches(ip string, matches []containerMatch) ([]containerMatch, error) {
+	result := make([]containerMatch, 0, len(matches))
+	untrusted := make([]string, 0)
+
+	for _, match := range matches {
+		trusted, err := isTrustedNetwork(match)
+		if err != nil {
+			return nil, err
+		}
+
+		if !trusted {
+			untrusted = append(untrusted, match.network)
+			continue
+		}
+
+		result = append(result, match)
+	}
+
+	if len(result) == 0 {
+		kind := errorKindForbidden
+		if untrustedNetworkMode == "passthrough" {
+			kind = errorKindNotFound
+		}
+
+		return nil, errorWithKind(kind, fmt.Errorf("%w: container with IP %s is only on the untrusted networks %s", errUntrustedNetwork, ip, strings.Join(untrusted, ", ")))
+	}
+
+	return result, nil
+}
+
+// hostInterface is a host network interface and its subnets
+type hostInterface struct {
+	name  string
+	addrs []*net.IPNet
+}
+
+// listHostInterfaces returns the network interfaces of the host (replaceable in tests)
+var listHostInterfaces = func() ([]hostInterface, error) {
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]hostInterface, 0, len(interfaces))
+	for _, iface := range interfaces {
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+
+		entry := hostInterface{name: iface.Name}
+		for _, addr := range addrs {
+			if ipnet, ok := addr.(*net.IPNet); ok {
+				entry.addrs = append(entry.addrs, ipnet)
+			}
+		}
+
+		result = append(result, entry)
+	}
+
+	return result, nil
+}
+
+// findIngressInterface returns the host interface requests from the IP arrive on, or an empty string if unknown
+//
+// When the request was received on an address of an interface with a subnet containing the IP (e.g. when DNAT'ing
+// to the bridge gateway), that interface is used. Otherwise it's the interface with the most specific subnet
+// containing the IP. Several interfaces matching equally well (overlapping subnets) is an error, as the interface
+// would be guessed
+func findIngressInterface(ip string, localAddr net.Addr) (string, error) {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return "", nil
+	}
+
+	interfaces, err := listHostInterfaces()
+	if err != nil {
+		return "", nil
+	}
+
+	if local := addrIP(localAddr); local != nil && !local.IsLoopback() {
+		var names []string
+		for _, iface := range interfaces {
+			for _, addr := range iface.addrs {
+				if addr.IP.Equal(local) && addr.Contains(parsed) {
+					names = append(names, iface.name)
+					break
+				}
+			}
+		}
+
+		if len(names) == 1 {
+			return names[0], nil
+		}
+
+		if len(names) > 1 {
+			return "", forbiddenErrorf("Requests from %s to %s could arrive on any of the interfaces %s", ip, local, strings.Join(names, ", "))
+		}
+	}
+
+	var names []string
+	best := -1
+	for _, iface := range interfaces {
+		for _, addr := range iface.addrs {
+			if !addr.Contains(parsed) {
+				continue
+			}
+
+			ones, _ := addr.Mask.Size()
+			if ones > best {
+				names, best = []string{iface.name}, ones
+			} else if ones == best && names[len(names)-1] != iface.name {
+				names = append(names, iface.name)
+			}
+		}
+	}
+
+	if len(names) > 1 {
+		return "", forbiddenErrorf("Requests from %s could arrive on any of the interfaces %s (overlapping subnets)", ip, strings.Join(names, ", "))
+	}
+
+	if len(names) == 0 {
+		return "", nil
+	}
+
+	return names[0], nil
+}
+
+// addrIP returns the IP of a TCP or UDP address
+func addrIP(addr net.Addr) net.IP {
+	switch v := addr.(type) {
+	case *net.TCPAddr:
+		return v.IP
+	case *net.UDPAddr:
+		return v.IP
+	default:
+		return nil
+	}
+}
+
+// findDockerNetwork returns the (cached) details of the Docker network
+func findDockerNetwork(networkID string) (*docker.Network, error) {
+	if network, ok := dockerNetworkCache.Get(networkID); ok {
+		return network.(*docker.Network), nil
+	}
+
+	network, err := dockerClient.NetworkInfo(networkID)
+	if err != nil {
+		return nil, err
+	}
+
+	dockerNetworkCache.Set(networkID, network, cache.DefaultExpiration)
+	return network, nil
+}
+
+// dockerNetworkInterface returns the host interface of a bridge network (e.g. docker0 or br-d180d436e9c4)
+func dockerNetworkInterface(network *docker.Network) (string, bool) {
+	if network.Driver != "bridge" {
+		return "", false
+	}
+
+	if name, ok := network.Options["com.docker.network.bridge.name"]; ok && name != "" {
+		return name, true
+	}
+
+	if len(network.ID) < 12 {
+		return "", false
+	}
+
+	return "br-" + network.ID[:12], true
+}
+
+// filterIngressMatches keeps the matches on the bridge network the request arrived on
+//
+// When the ingress interface is unknown (e.g. go-metadataproxy doesn't use the host network) or not a Docker bridge
+// (e.g. macvlan networks), the matches are kept as-is
+func filterIngressMatches(ip string, localAddr net.Addr, matches []containerMatch, request *Request) ([]containerMatch, error) {
+	if isIngressVerificationSkipped {
+		return matches, nil
+	}
+
+	ingress, err := findIngressInterface(ip, localAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	if ingress == "" {
+		request.log.Debugf("Could not find the ingress interface for %s, skipping ingress verification", ip)
+		return matches, nil
+	}
+
+	request.setLogLabel("ingress_interface", ingress)
+
+	result := make([]containerMatch, 0, len(matches))
+	bridged := false
+	for _, match := range matches {
+		network, err := findDockerNetwork(match.networkID)
+		if err != nil {
+			return nil, err
+		}
+
+		name, ok := dockerNetworkInterface(network)
+		if !ok {
+			continue
+		}
+
+		bridged = true
+		if name == ingress {
+			result = append(result, match)
+		}
+	}
+
+	// none of the networks are bridges, so the ingress interface can't be compared
+	if !bridged {
+		return matches, nil
+	}
+
+	if len(result) == 0 {
+		return nil, forbiddenErrorf("Container with IP %s is not on the network of ingress interface %s", ip, ingress)
+	}
+
+	return result, nil
+}
@@ -0,0 +1,127 @@
+package internal
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestFindIngressInterface(t *testing.T) {
+	defer func(list func() ([]hostInterface, error)) { listHostInterfaces = list }(listHostInterfaces)
+
+	mustCIDR := func(value string) *net.IPNet {
+		ip, network, err := net.ParseCIDR(value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		network.IP = ip
+		return network
+	}
+
+	listHostInterfaces = func() ([]hostInterface, error) {
+		return []hostInterface{
+			{name: "lo", addrs: []*net.IPNet{mustCIDR("127.0.0.1/8")}},
+			{name: "eth0", addrs: []*net.IPNet{mustCIDR("10.0.0.10/16")}},
+			{name: "docker0", addrs: []*net.IPNet{mustCIDR("172.17.0.1/16")}},
+			{name: "br-aaaaaaaaaaaa", addrs: []*net.IPNet{mustCIDR("172.20.0.1/16")}},
+			{name: "br-bbbbbbbbbbbb", addrs: []*net.IPNet{mustCIDR("172.20.0.2/16")}},
+			{name: "br-cccccccccccc", addrs: []*net.IPNet{mustCIDR("10.0.5.1/24")}},
+		}, nil
+	}
+
+	tests := []struct {
+		name      string
+		ip        string
+		localAddr net.Addr
+		expected  string
+		wantErr   bool
+	}{
+		{name: "single subnet", ip: "172.17.0.2", expected: "docker0"},
+		{name: "single subnet on loopback", ip: "172.17.0.2", localAddr: &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 8000}, expected: "docker0"},
+		{name: "most specific subnet", ip: "10.0.5.20", expected: "br-cccccccccccc"},
+		{name: "overlapping subnets", ip: "172.20.0.5", wantErr: true},
+		{name: "overlapping subnets on loopback", ip: "172.20.0.5", localAddr: &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 8000}, wantErr: true},
+		{name: "overlapping subnets on host address", ip: "172.20.0.5", localAddr: &net.TCPAddr{IP: net.ParseIP("10.0.0.10"), Port: 8000}, wantErr: true},
+		{name: "overlapping subnets on gateway", ip: "172.20.0.5", localAddr: &net.TCPAddr{IP: net.ParseIP("172.20.0.2"), Port: 8000}, expected: "br-bbbbbbbbbbbb"},
+		{name: "unknown subnet", ip: "192.168.1.10", expected: ""},
+		{name: "invalid IP", ip: "[fd00", expected: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ingress, err := findIngressInterface(tt.ip, tt.localAddr)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got %q", ingress)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if ingress != tt.expected {
+				t.Errorf("expected %q, got %q", tt.expected, ingress)
+			}
+		})
+	}
+}
+
+func TestFilterTrustedMatches(t *testing.T) {
+	defer func(networks []string, mode string) {
+		trustedNetworks, untrustedNetworkMode = networks, mode
+	}(trustedNetworks, untrustedNetworkMode)
+
+	bridge := containerMatch{network: "bridge", networkID: "d180d436e9c4c4322156140ba04233a530a30966ddbcd7f9be4331724d78f459"}
+	macvlan := containerMatch{network: "vpc", networkID: "5e3a1f0b7c2d9e8f6a4b3c2d1e0f9a8b7c6d5e4f3a2b1c0d9e8f7a6b5c4d3e2f"}
+
+	tests := []struct {
+		name     string
+		trusted  string
+		mode     string
+		matches  []containerMatch
+		expected []string
+		kind     errorKind
+	}{
+		{name: "no trusted networks", matches: []containerMatch{bridge, macvlan}, expected: []string{"bridge", "vpc"}},
+		{name: "trusted by name", trusted: "bridge", matches: []containerMatch{bridge, macvlan}, expected: []string{"bridge"}},
+		{name: "trusted by ID", trusted: bridge.networkID, matches: []containerMatch{bridge, macvlan}, expected: []string{"bridge"}},
+		{name: "trusted by ID prefix", trusted: "d180d436e9c4", matches: []containerMatch{bridge, macvlan}, expected: []string{"bridge"}},
+		{name: "too short ID prefix", trusted: "d180d4", mode: "deny", matches: []containerMatch{bridge}, kind: errorKindForbidden},
+		{name: "untrusted in deny mode", trusted: "bridge", mode: "deny", matches: []containerMatch{macvlan}, kind: errorKindForbidden},
+		{name: "untrusted in passthrough mode", trusted: "bridge", mode: "passthrough", matches: []containerMatch{macvlan}, kind: errorKindNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			trustedNetworks, untrustedNetworkMode = parseTrustedNetworks(tt.trusted), tt.mode
+
+			result, err := filterTrustedMatches("172.17.0.2", tt.matches)
+			if tt.expected == nil {
+				if err == nil {
+					t.Fatalf("expected an error, got %d matches", len(result))
+				}
+
+				if !errors.Is(err, errUntrustedNetwork) || classifyError(err, errorKindInternal) != tt.kind {
+					t.Errorf("expected an untrusted network error of kind %v, got %s", tt.kind, err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			networks := make([]string, 0, len(result))
+			for _, match := range result {
+				networks = append(networks, match.network)
+			}
+
+			if strings.Join(networks, ",") != strings.Join(tt.expected, ",") {
+				t.Errorf("expected %v, got %v", tt.expected, networks)
+			}
+		})
+	}
+}
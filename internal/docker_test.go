@@ -0,0 +1,211 @@
+package internal
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	docker "github.com/fsouza/go-dockerclient"
+)
+
+func TestFindDockerContainerMount(t *testing.T) {
+	container := &docker.Container{
+		Mounts: []docker.Mount{
+			{Source: "/host/var", Destination: "/var"},
+			{Source: "/host/secrets", Destination: "/var/run/secrets"},
+			{Source: "/host/data", Destination: "/data"},
+		},
+	}
+
+	tests := []struct {
+		name   string
+		file   string
+		source string
+		rel    string
+		found  bool
+	}{
+		{name: "single mount", file: "/data/token", source: "/host/data", rel: "token", found: true},
+		{name: "most specific mount", file: "/var/run/secrets/token", source: "/host/secrets", rel: "token", found: true},
+		{name: "parent mount", file: "/var/lib/token", source: "/host/var", rel: "lib/token", found: true},
+		{name: "sibling with common prefix", file: "/database/token", found: false},
+		{name: "dot dot prefixed name", file: "/data/..token", source: "/host/data", rel: "..token", found: true},
+		{name: "outside of mounts", file: "/etc/shadow", found: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mount, rel, found := findDockerContainerMount(container, tt.file)
+			if found != tt.found {
+				t.Fatalf("expected found %t, got %t", tt.found, found)
+			}
+
+			if found && (mount.Source != tt.source || rel != tt.rel) {
+				t.Errorf("expected %s %s, got %s %s", tt.source, tt.rel, mount.Source, rel)
+			}
+		})
+	}
+}
+
+func TestReadDockerMountFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "metadataproxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	mount := filepath.Join(dir, "mount")
+	mustWriteFile(t, filepath.Join(mount, "token"), "in-mount")
+	mustWriteFile(t, filepath.Join(mount, "nested", "token"), "nested")
+	mustWriteFile(t, filepath.Join(dir, "secret"), "outside")
+
+	mustSymlink(t, "nested/token", filepath.Join(mount, "relative-link"))
+	mustSymlink(t, filepath.Join(dir, "secret"), filepath.Join(mount, "absolute-link"))
+	mustSymlink(t, "../secret", filepath.Join(mount, "escaping-link"))
+	mustSymlink(t, dir, filepath.Join(mount, "escaping-dir"))
+
+	tests := []struct {
+		name     string
+		rel      string
+		expected string
+		wantErr  bool
+	}{
+		{name: "regular file", rel: "token", expected: "in-mount"},
+		{name: "nested file", rel: "nested/token", expected: "nested"},
+		{name: "symlink within mount", rel: "relative-link", expected: "nested"},
+		{name: "absolute symlink outside of mount", rel: "absolute-link", wantErr: true},
+		{name: "relative symlink outside of mount", rel: "escaping-link", wantErr: true},
+		{name: "symlinked directory outside of mount", rel: "escaping-dir/secret", wantErr: true},
+		{name: "directory", rel: "nested", wantErr: true},
+		{name: "missing file", rel: "missing", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := readDockerMountFile(mount, tt.rel)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got %q", data)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if string(data) != tt.expected {
+				t.Errorf("expected %q, got %q", tt.expected, data)
+			}
+		})
+	}
+}
+
+func mustWriteFile(t *testing.T, path, content string) {
+	t.Helper()
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func mustSymlink(t *testing.T, target, path string) {
+	t.Helper()
+
+	if err := os.Symlink(target, path); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// newFakeDockerDaemon points the Docker client to a fake daemon serving the (running) containers
+func newFakeDockerDaemon(t *testing.T, containers ...*docker.Container) {
+	t.Helper()
+
+	daemon := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/containers/json") {
+			listed := make([]docker.APIContainers, 0, len(containers))
+			for _, container := range containers {
+				networks := make(map[string]docker.ContainerNetwork)
+				for name, network := range container.NetworkSettings.Networks {
+					networks[name] = docker.ContainerNetwork{IPAddress: network.IPAddress, NetworkID: network.NetworkID}
+				}
+
+				listed = append(listed, docker.APIContainers{
+					ID:       container.ID,
+					Names:    []string{container.Name},
+					Image:    container.Config.Image,
+					State:    "running",
+					Networks: docker.NetworkList{Networks: networks},
+				})
+			}
+
+			json.NewEncoder(w).Encode(listed)
+			return
+		}
+
+		for _, container := range containers {
+			if strings.HasSuffix(r.URL.Path, "/containers/"+container.ID+"/json") {
+				json.NewEncoder(w).Encode(container)
+				return
+			}
+		}
+
+		http.NotFound(w, r)
+	}))
+	t.Cleanup(daemon.Close)
+
+	client, err := docker.NewClient(daemon.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	previous := dockerClient
+	dockerClient = client
+	t.Cleanup(func() { dockerClient = previous })
+}
+
+// newFakeContainer returns a running container with the IP on the bridge network
+func newFakeContainer(id, ip string, env ...string) *docker.Container {
+	return &docker.Container{
+		ID:     id,
+		Name:   "/" + id,
+		Config: &docker.Config{Image: id + ":latest", Env: env},
+		State:  docker.State{Running: true},
+		NetworkSettings: &docker.NetworkSettings{
+			Networks: map[string]docker.ContainerNetwork{
+				"bridge": {IPAddress: ip, NetworkID: "d180d436e9c4c4322156140ba04233a530a30966ddbcd7f9be4331724d78f459"},
+			},
+		},
+	}
+}
+
+func TestFindContainerInformationDenied(t *testing.T) {
+	newFakeDockerDaemon(t, newFakeContainer("web-1", "172.17.0.2"), newFakeContainer("web-2", "172.17.0.2"))
+
+	defer func(skipped bool) { isIngressVerificationSkipped = skipped }(isIngressVerificationSkipped)
+	isIngressVerificationSkipped = true
+
+	r := httptest.NewRequest(http.MethodGet, "/latest/meta-data/iam/security-credentials/", nil)
+	r.RemoteAddr = "172.17.0.2:41234"
+	request := NewRequest(r, "test", "/test")
+
+	start := time.Now()
+	_, err := findContainerInformation(r.RemoteAddr, request, request.datadogSpan)
+	if classifyError(err, errorKindNotFound) != errorKindForbidden {
+		t.Fatalf("expected a forbidden error, got %v", err)
+	}
+
+	// denied callers are not retried until the backoff gives up
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("expected the lookup to fail right away, took %s", elapsed)
+	}
+}
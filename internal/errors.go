@@ -0,0 +1,228 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws/awserr"
+	docker "github.com/fsouza/go-dockerclient"
+)
+
+var (
+	// expose the error kind, code and message in response headers (for debugging)
+	isErrorHeadersEnabled = os.Getenv("ENABLE_ERROR_HEADERS") != ""
+)
+
+// errorKind classifies an error, deciding the status code and body sent to the client
+type errorKind int
+
+const (
+	errorKindNotFound errorKind = iota
+	errorKindForbidden
+	errorKindThrottled
+	errorKindInternal
+	errorKindBadRequest
+	errorKindMethodNotAllowed
+	errorKindUnauthorized
+)
+
+// AWS error codes returned when an API call is throttled
+var awsThrottleErrorCodes = map[string]bool{
+	"Throttling":                             true,
+	"ThrottlingException":                    true,
+	"ThrottledException":                     true,
+	"RequestThrottled":                       true,
+	"RequestThrottledException":              true,
+	"RequestLimitExceeded":                   true,
+	"TooManyRequestsException":               true,
+	"PriorRequestNotComplete":                true,
+	"ProvisionedThroughputExceededException": true,
+}
+
+// AWS error codes returned when an API call is denied by policy
+var awsForbiddenErrorCodes = map[string]bool{
+	"AccessDenied":                true,
+	"AccessDeniedException":       true,
+	"RegionDisabledException":     true,
+	"ExpiredToken":                true,
+	"ExpiredTokenException":       true,
+	"InvalidIdentityToken":        true,
+	"IDPRejectedClaim":            true,
+	"InvalidClientTokenId":        true,
+	"UnrecognizedClientException": true,
+}
+
+// AWS error codes returned when the requested entity does not exist
+var awsNotFoundErrorCodes = map[string]bool{
+	"NoSuchEntity": true,
+}
+
+// kindError attaches an errorKind to an error
+type kindError struct {
+	kind errorKind
+	err  error
+}
+
+func (e *kindError) Error() string {
+	return e.err.Error()
+}
+
+func (e *kindError) Unwrap() error {
+	return e.err
+}
+
+// errorWithKind wraps the error so HandleError will respond with the kind
+func errorWithKind(kind errorKind, err error) error {
+	return &kindError{kind: kind, err: err}
+}
+
+// notFoundErrorf formats an error for something the caller asked for, which doesn't exist
+func notFoundErrorf(format string, args ...interface{}) error {
+	return errorWithKind(errorKindNotFound, fmt.Errorf(format, args...))
+}
+
+// forbiddenErrorf formats an error for a request denied by policy
+func forbiddenErrorf(format string, args ...interface{}) error {
+	return errorWithKind(errorKindForbidden, fmt.Errorf(format, args...))
+}
+
+// classifyError finds the errorKind of the error, using fallback when the error carries no hints
+func classifyError(err error, fallback errorKind) errorKind {
+	var ke *kindError
+	if errors.As(err, &ke) {
+		return ke.kind
+	}
+
+	var awsErr awserr.Error
+	if errors.As(err, &awsErr) {
+		switch {
+		case awsThrottleErrorCodes[awsErr.Code()]:
+			return errorKindThrottled
+		case awsForbiddenErrorCodes[awsErr.Code()]:
+			return errorKindForbidden
+		case awsNotFoundErrorCodes[awsErr.Code()]:
+			return errorKindNotFound
+		}
+
+		var failure awserr.RequestFailure
+		if errors.As(err, &failure) {
+			switch {
+			case failure.StatusCode() == http.StatusTooManyRequests:
+				return errorKindThrottled
+			case failure.StatusCode() >= 500:
+				return errorKindInternal
+			}
+		}
+
+		return fallback
+	}
+
+	var noSuchContainer *docker.NoSuchContainer
+	if errors.As(err, &noSuchContainer) {
+		return errorKindNotFound
+	}
+
+	var dockerErr *docker.Error
+	if errors.As(err, &dockerErr) {
+		return errorKindInternal
+	}
+
+	// the Docker daemon or an upstream didn't answer in time, or at all
+	var netErr net.Error
+	if errors.As(err, &netErr) || errors.Is(err, context.DeadlineExceeded) {
+		return errorKindInternal
+	}
+
+	return fallback
+}
+
+// statusCode returns the HTTP status code used by IMDS for the errorKind
+func (k errorKind) statusCode() int {
+	switch k {
+	case errorKindForbidden:
+		return http.StatusForbidden
+	case errorKindThrottled:
+		return http.StatusTooManyRequests
+	case errorKindInternal:
+		return http.StatusInternalServerError
+	case errorKindBadRequest:
+		return http.StatusBadRequest
+	case errorKindMethodNotAllowed:
+		return http.StatusMethodNotAllowed
+	case errorKindUnauthorized:
+		return http.StatusUnauthorized
+	default:
+		return http.StatusNotFound
+	}
+}
+
+func (k errorKind) String() string {
+	switch k {
+	case errorKindForbidden:
+		return "forbidden"
+	case errorKindThrottled:
+		return "throttled"
+	case errorKindInternal:
+		return "internal"
+	case errorKindBadRequest:
+		return "bad_request"
+	case errorKindMethodNotAllowed:
+		return "method_not_allowed"
+	case errorKindUnauthorized:
+		return "unauthorized"
+	default:
+		return "not_found"
+	}
+}
+
+// the error page served by IMDS, e.g. "404 - Not Found"
+const imdsErrorTemplate = `<?xml version="1.0" encoding="iso-8859-1"?>
+<!DOCTYPE html PUBLIC "-//W3C//DTD XHTML 1.0 Transitional//EN"
+	"http://www.w3.org/TR/xhtml1/DTD/xhtml1-transitional.dtd">
+<html xmlns="http://www.w3.org/1999/xhtml" xml:lang="en" lang="en">
+ <head>
+  <title>%[1]s</title>
+ </head>
+ <body>
+  <h1>%[1]s</h1>
+ </body>
+</html>
+`
+
+// writeErrorResponse sends the error in the format of the endpoint, HTML for IMDS and JSON for the
+// ECS, Pod Identity and admin endpoints
+func writeErrorResponse(w http.ResponseWriter, kind errorKind, description string, err error, asJSON bool) {
+	code := kind.statusCode()
+
+	if isErrorHeadersEnabled {
+		w.Header().Set("X-Metadataproxy-Error-Kind", kind.String())
+		w.Header().Set("X-Metadataproxy-Error-Code", description)
+		w.Header().Set("X-Metadataproxy-Error-Message", sanitizeHeaderValue(err.Error()))
+	}
+
+	if kind == errorKindThrottled {
+		w.Header().Set("Retry-After", "1")
+	}
+
+	if asJSON {
+		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+		w.WriteHeader(code)
+		json.NewEncoder(w).Encode(map[string]string{"code": description, "message": http.StatusText(code)})
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html")
+	w.WriteHeader(code)
+	fmt.Fprintf(w, imdsErrorTemplate, fmt.Sprintf("%d - %s", code, http.StatusText(code)))
+}
+
+// sanitizeHeaderValue removes line breaks, which are not allowed in header values
+func sanitizeHeaderValue(value string) string {
+	return strings.NewReplacer("\r", " ", "\n", " ").Replace(value)
+}
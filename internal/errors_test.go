@@ -0,0 +1,45 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws/awserr"
+	docker "github.com/fsouza/go-dockerclient"
+)
+
+func TestClassifyError(t *testing.T) {
+	tests := []struct {
+		name     string
+		err      error
+		fallback errorKind
+		expected errorKind
+	}{
+		{name: "plain error", err: errors.New("boom"), fallback: errorKindNotFound, expected: errorKindNotFound},
+		{name: "plain error with internal fallback", err: errors.New("boom"), fallback: errorKindInternal, expected: errorKindInternal},
+		{name: "forbidden", err: forbiddenErrorf("denied"), fallback: errorKindInternal, expected: errorKindForbidden},
+		{name: "wrapped not found", err: fmt.Errorf("lookup: %w", notFoundErrorf("missing")), fallback: errorKindInternal, expected: errorKindNotFound},
+		{name: "aws throttled", err: awserr.New("Throttling", "Rate exceeded", nil), fallback: errorKindNotFound, expected: errorKindThrottled},
+		{name: "aws access denied", err: awserr.New("AccessDenied", "not authorized", nil), fallback: errorKindNotFound, expected: errorKindForbidden},
+		{name: "aws no such entity", err: awserr.New("NoSuchEntity", "role not found", nil), fallback: errorKindInternal, expected: errorKindNotFound},
+		{name: "aws 429", err: awserr.NewRequestFailure(awserr.New("Unknown", "slow down", nil), http.StatusTooManyRequests, "id"), fallback: errorKindNotFound, expected: errorKindThrottled},
+		{name: "aws 503", err: awserr.NewRequestFailure(awserr.New("Unknown", "unavailable", nil), http.StatusServiceUnavailable, "id"), fallback: errorKindNotFound, expected: errorKindInternal},
+		{name: "aws unknown code", err: awserr.New("ValidationError", "invalid", nil), fallback: errorKindNotFound, expected: errorKindNotFound},
+		{name: "docker no such container", err: &docker.NoSuchContainer{ID: "web"}, fallback: errorKindInternal, expected: errorKindNotFound},
+		{name: "docker error", err: &docker.Error{Status: http.StatusInternalServerError, Message: "daemon error"}, fallback: errorKindNotFound, expected: errorKindInternal},
+		{name: "network error", err: &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}, fallback: errorKindNotFound, expected: errorKindInternal},
+		{name: "deadline exceeded", err: fmt.Errorf("request: %w", context.DeadlineExceeded), fallback: errorKindNotFound, expected: errorKindInternal},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if kind := classifyError(tt.err, tt.fallback); kind != tt.expected {
+				t.Errorf("expected %s, got %s", tt.expected, kind)
+			}
+		})
+	}
+}
@@ -0,0 +1,231 @@
+package internal
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	docker "github.com/fsouza/go-dockerclient"
+)
+
+const (
+	eventTypeSpotInterruption = "spot-interruption"
+	eventTypeRebalance        = "rebalance"
+	eventTypeMaintenance      = "maintenance"
+
+	maintenanceTimeLayout = "2 Jan 2006 15:04:05 GMT"
+)
+
+var (
+	isEventSimulationEnabled = os.Getenv("ENABLE_EVENT_SIMULATION") != ""
+	simulatedEvents          = &simulatedEventStore{events: make(map[string]*simulatedEvent)}
+)
+
+// simulatedEvent is a spot interruption, rebalance recommendation or scheduled maintenance event
+// served in place of the upstream IMDS responses
+type simulatedEvent struct {
+	ID          string    `json:"id"`
+	Type        string    `json:"type"`
+	Container   string    `json:"container,omitempty"`
+	VisibleAt   time.Time `json:"visible_at"`
+	Time        time.Time `json:"time"`
+	NotAfter    time.Time `json:"not_after,omitempty"`
+	Action      string    `json:"action,omitempty"`
+	Code        string    `json:"code,omitempty"`
+	Description string    `json:"description,omitempty"`
+}
+
+type simulatedEventStore struct {
+	sync.RWMutex
+	events map[string]*simulatedEvent
+}
+
+// add validates the event, fills in defaults and stores it
+func (s *simulatedEventStore) add(event *simulatedEvent) error {
+	now := time.Now().UTC()
+
+	if event.VisibleAt.IsZero() {
+		event.VisibleAt = now
+	}
+
+	switch event.Type {
+	case eventTypeSpotInterruption:
+		if event.Action == "" {
+			event.Action = "terminate"
+		}
+		if event.Time.IsZero() {
+			event.Time = event.VisibleAt.Add(2 * time.Minute)
+		}
+
+	case eventTypeRebalance:
+		if event.Time.IsZero() {
+			event.Time = event.VisibleAt
+		}
+
+	case eventTypeMaintenance:
+		if event.Code == "" {
+			event.Code = "system-reboot"
+		}
+		if event.Time.IsZero() {
+			event.Time = event.VisibleAt.Add(24 * time.Hour)
+		}
+		if event.NotAfter.IsZero() {
+			event.NotAfter = event.Time.Add(2 * time.Hour)
+		}
+
+	default:
+		return fmt.Errorf("Unknown event type '%s' (%s, %s or %s)", event.Type, eventTypeSpotInterruption, eventTypeRebalance, eventTypeMaintenance)
+	}
+
+	id := make([]byte, 9)
+	if _, err := rand.Read(id); err != nil {
+		return err
+	}
+	event.ID = "instance-event-" + hex.EncodeToString(id)[:17]
+
+	s.Lock()
+	defer s.Unlock()
+	s.events[event.ID] = event
+
+	return nil
+}
+
+// remove removes the event with the ID, or all events (for the container, if not empty) if the ID is empty
+func (s *simulatedEventStore) remove(id, container string) int {
+	s.Lock()
+	defer s.Unlock()
+
+	removed := 0
+	for eventID, event := range s.events {
+		if id != "" && eventID != id {
+			continue
+		}
+
+		if container != "" && event.Container != container {
+			continue
+		}
+
+		delete(s.events, eventID)
+		removed++
+	}
+
+	return removed
+}
+
+// list returns all events, sorted by their time
+func (s *simulatedEventStore) list() []*simulatedEvent {
+	s.RLock()
+	defer s.RUnlock()
+
+	result := make([]*simulatedEvent, 0, len(s.events))
+	for _, event := range s.events {
+		result = append(result, event)
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Time.Before(result[j].Time)
+	})
+
+	return result
+}
+
+// visible returns the events of the type that are visible to the container (global events and events for the container)
+func (s *simulatedEventStore) visible(eventType string, container *docker.Container) []*simulatedEvent {
+	now := time.Now()
+
+	result := make([]*simulatedEvent, 0)
+	for _, event := range s.list() {
+		if event.Type != eventType || event.VisibleAt.After(now) {
+			continue
+		}
+
+		if event.Container != "" && !matchesContainer(event.Container, container) {
+			continue
+		}
+
+		result = append(result, event)
+	}
+
+	return result
+}
+
+// matchesContainer returns true if the reference is the (short) ID or name of the container
+func matchesContainer(reference string, container *docker.Container) bool {
+	if container == nil {
+		return false
+	}
+
+	if strings.HasPrefix(container.ID, reference) && len(reference) >= 12 {
+		return true
+	}
+
+	return strings.TrimPrefix(container.Name, "/") == strings.TrimPrefix(reference, "/")
+}
+
+// renderSimulatedEvents renders the events in the format IMDS uses for the path, returning false if there
+// are no events to serve
+func renderSimulatedEvents(path string, container *docker.Container) (interface{}, bool) {
+	switch path {
+	case "spot/instance-action":
+		events := simulatedEvents.visible(eventTypeSpotInterruption, container)
+		if len(events) == 0 {
+			return nil, false
+		}
+
+		return map[string]string{
+			"action": events[0].Action,
+			"time":   events[0].Time.UTC().Format(awsTimeLayoutResponse),
+		}, true
+
+	case "spot/termination-time":
+		events := simulatedEvents.visible(eventTypeSpotInterruption, container)
+		if len(events) == 0 || events[0].Action != "terminate" {
+			return nil, false
+		}
+
+		return events[0].Time.UTC().Format(awsTimeLayoutResponse), true
+
+	case "events/recommendations/rebalance":
+		events := simulatedEvents.visible(eventTypeRebalance, container)
+		if len(events) == 0 {
+			return nil, false
+		}
+
+		return map[string]string{
+			"noticeTime": events[0].Time.UTC().Format(awsTimeLayoutResponse),
+		}, true
+
+	case "events/maintenance/scheduled":
+		events := simulatedEvents.visible(eventTypeMaintenance, container)
+		if len(events) == 0 {
+			return nil, false
+		}
+
+		result := make([]map[string]string, 0, len(events))
+		for _, event := range events {
+			state := "active"
+			if time.Now().After(event.NotAfter) {
+				state = "completed"
+			}
+
+			result = append(result, map[string]string{
+				"NotBefore":   event.Time.UTC().Format(maintenanceTimeLayout),
+				"Code":        event.Code,
+				"Description": event.Description,
+				"EventId":     event.ID,
+				"NotAfter":    event.NotAfter.UTC().Format(maintenanceTimeLayout),
+				"State":       state,
+			})
+		}
+
+		return result, true
+
+	default:
+		return nil, false
+	}
+}
@@ -0,0 +1,289 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+	docker "github.com/fsouza/go-dockerclient"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/tracer"
+)
+
+var (
+	readinessTimeout   = 2 * time.Second
+	stsSuccessWindow   = getenvDefault("READY_STS_SUCCESS_WINDOW", "5m")
+	lastSTSSuccessTime int64
+
+	// go-metadataproxy has no container index, containers are looked up in the Docker daemon per request
+	lastContainerLookupTime int64
+)
+
+// healthCheck is the result of a single readiness check
+type healthCheck struct {
+	Status    string  `json:"status"`
+	LatencyMs float64 `json:"latency_ms"`
+	Details   string  `json:"details,omitempty"`
+	Error     string  `json:"error,omitempty"`
+}
+
+// recordSTSSuccess marks STS as reachable with the host or source credentials of the client, so readiness checks can
+// skip calling STS with them
+//
+// Calls with other clients (broker roles, web identity) don't say anything about the configured credentials
+func recordSTSSuccess(client *sts.Client) {
+	now := time.Now().UnixNano()
+	if client == stsService {
+		atomic.StoreInt64(&lastSTSSuccessTime, now)
+		return
+	}
+
+	for _, source := range sourceCredentialsList {
+		if source.client == client {
+			atomic.StoreInt64(&source.lastSuccessTime, now)
+		}
+	}
+}
+
+// recordContainerLookup marks a caller as identified, which the containers readiness check reports
+func recordContainerLookup() {
+	atomic.StoreInt64(&lastContainerLookupTime, time.Now().UnixNano())
+}
+
+// degradedError is a failed readiness check, which doesn't make go-metadataproxy unready
+type degradedError struct {
+	err error
+}
+
+func (e *degradedError) Error() string {
+	return e.err.Error()
+}
+
+// readinessChecks are the dependencies go-metadataproxy needs to serve requests
+var readinessChecks = map[string]func(ctx context.Context) (string, error){
+	"docker":     checkDocker,
+	"containers": checkContainers,
+	"sts":        checkSTS,
+	"upstream":   checkUpstream,
+}
+
+// checkDocker verifies the Docker daemon is reachable
+func checkDocker(ctx context.Context) (string, error) {
+	if err := dockerClient.PingWithContext(ctx); err != nil {
+		return "", err
+	}
+
+	// Info() doesn't take a context, so stop waiting for it when the check times out
+	type infoResult struct {
+		info *docker.DockerInfo
+		err  error
+	}
+
+	result := make(chan infoResult, 1)
+	go func() {
+		info, err := dockerClient.Info()
+		result <- infoResult{info, err}
+	}()
+
+	select {
+	case <-ctx.Done():
+		return "", ctx.Err()
+	case res := <-result:
+		if res.err != nil {
+			return "", res.err
+		}
+
+		return fmt.Sprintf("%s @ %s", res.info.Name, res.info.ServerVersion), nil
+	}
+}
+
+// checkContainers verifies the running containers can be listed, which is needed to identify callers, and reports when a
+// caller was last identified
+func checkContainers(ctx context.Context) (string, error) {
+	containers, err := dockerClient.ListContainers(docker.ListContainersOptions{
+		Filters: map[string][]string{"status": {"running"}},
+		Context: ctx,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	lookup := "no caller identified yet"
+	if last := atomic.LoadInt64(&lastContainerLookupTime); last != 0 {
+		lookup = fmt.Sprintf("last caller identified %s ago", time.Since(time.Unix(0, last)).Round(time.Second))
+	}
+
+	return fmt.Sprintf("%d running containers, %s", len(containers), lookup), nil
+}
+
+// checkSTS verifies STS is reachable with the host credentials and each of the SOURCE_CREDENTIALS, either by a recent
+// successful call or a GetCallerIdentity call
+//
+// Source credentials only serve the roles matching their pattern, so failing ones degrade the check instead of failing it
+func checkSTS(ctx context.Context) (string, error) {
+	if isLocalMode {
+		return "skipped in local mode", nil
+	}
+
+	window, err := time.ParseDuration(stsSuccessWindow)
+	if err != nil {
+		return "", fmt.Errorf("Invalid value for READY_STS_SUCCESS_WINDOW: %s", stsSuccessWindow)
+	}
+
+	details, err := probeSTS(ctx, stsService, &lastSTSSuccessTime, window)
+	if err != nil {
+		return "", fmt.Errorf("host: %s", err.Error())
+	}
+
+	results := []string{"host: " + details}
+	var failures []string
+	for _, source := range sourceCredentialsList {
+		name := fmt.Sprintf("%s source credentials (%s)", source.kind, source.pattern)
+
+		details, err := probeSTS(ctx, source.client, &source.lastSuccessTime, window)
+		if err != nil {
+			failures = append(failures, fmt.Sprintf("%s: %s", name, err.Error()))
+			continue
+		}
+
+		results = append(results, fmt.Sprintf("%s: %s", name, details))
+	}
+
+	if len(failures) > 0 {
+		return strings.Join(results, ", "), &degradedError{fmt.Errorf("%s", strings.Join(failures, ", "))}
+	}
+
+	return strings.Join(results, ", "), nil
+}
+
+// probeSTS calls GetCallerIdentity with the client, unless a call with it succeeded within the window
+func probeSTS(ctx context.Context, client *sts.Client, lastSuccessTime *int64, window time.Duration) (string, error) {
+	if last := time.Unix(0, atomic.LoadInt64(lastSuccessTime)); time.Since(last) < window {
+		return fmt.Sprintf("last successful call %s ago", time.Since(last).Round(time.Second)), nil
+	}
+
+	req := client.GetCallerIdentityRequest(&sts.GetCallerIdentityInput{})
+	if _, err := req.Send(ctx); err != nil {
+		return "", err
+	}
+
+	recordSTSSuccess(client)
+	return "GetCallerIdentity succeeded", nil
+}
+
+// checkUpstream verifies the upstream metadata service is reachable, any HTTP response (e.g. 401 with IMDSv2) will do
+func checkUpstream(ctx context.Context) (string, error) {
+	if isMetadataEmulated {
+		return "skipped with metadata emulation", nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, upstreamURL("/latest/meta-data/").String(), nil)
+	if err != nil {
+		return "", err
+	}
+
+	resp, _, err := doUpstreamRequest(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 500 {
+		return "", fmt.Errorf("Upstream metadata returned %d", resp.StatusCode)
+	}
+
+	return fmt.Sprintf("responded with %d", resp.StatusCode), nil
+}
+
+// runReadinessChecks runs all checks concurrently, and returns if all of them passed
+func runReadinessChecks(ctx context.Context) (map[string]*healthCheck, bool) {
+	results := make(map[string]*healthCheck, len(readinessChecks))
+	ready := true
+
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	for name, check := range readinessChecks {
+		wg.Add(1)
+		go func(name string, check func(ctx context.Context) (string, error)) {
+			defer wg.Done()
+
+			ctx, cancel := context.WithTimeout(ctx, readinessTimeout)
+			defer cancel()
+
+			start := time.Now()
+			details, err := check(ctx)
+			result := &healthCheck{
+				Status:    "ok",
+				LatencyMs: float64(time.Since(start).Microseconds()) / 1000,
+				Details:   details,
+			}
+
+			var degraded *degradedError
+			switch {
+			case errors.As(err, &degraded):
+				result.Status = "degraded"
+				result.Error = err.Error()
+			case err != nil:
+				result.Status = "fail"
+				result.Error = err.Error()
+			}
+
+			lock.Lock()
+			defer lock.Unlock()
+
+			results[name] = result
+			if result.Status == "fail" {
+				ready = false
+			}
+		}(name, check)
+	}
+	wg.Wait()
+
+	return results, ready
+}
+
+// handles: /healthz
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	request := NewRequest(r, "healthz", "/healthz")
+	defer request.incrCounterWithLabels([]string{"http_request"}, 1)
+
+	// publish specific go-metadataproxy headers
+	request.setResponseHeaders(w)
+
+	request.setLabel("response_code", "200")
+	sendJSONResponse(w, map[string]string{"status": "ok"})
+}
+
+// handles: /readyz
+func readyzHandler(w http.ResponseWriter, r *http.Request) {
+	request := NewRequest(r, "readyz", "/readyz")
+	defer request.incrCounterWithLabels([]string{"http_request"}, 1)
+
+	// publish specific go-metadataproxy headers
+	request.setResponseHeaders(w)
+
+	checks, ready := runReadinessChecks(tracer.ContextWithSpan(r.Context(), request.datadogSpan))
+
+	status, code := "ok", http.StatusOK
+	if !ready {
+		status, code = "fail", http.StatusServiceUnavailable
+	}
+
+	for name, check := range checks {
+		request.setLogLabel("check."+name, check.Status)
+		if check.Error != "" {
+			request.log.Warnf("Readiness check %s failed: %s", name, check.Error)
+		}
+	}
+
+	request.setLabel("response_code", fmt.Sprintf("%d", code))
+	sendJSONResponseWithStatus(w, code, map[string]interface{}{
+		"status": status,
+		"checks": checks,
+	})
+}
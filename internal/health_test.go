@@ -0,0 +1,101 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+	docker "github.com/fsouza/go-dockerclient"
+)
+
+func TestCheckDockerTimeout(t *testing.T) {
+	release := make(chan struct{})
+	daemon := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/info") {
+			// a daemon that accepts connections but never answers
+			<-release
+		}
+
+		w.Write([]byte("OK"))
+	}))
+	t.Cleanup(daemon.Close)
+	t.Cleanup(func() { close(release) })
+
+	client, err := docker.NewClient(daemon.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	previous := dockerClient
+	dockerClient = client
+	t.Cleanup(func() { dockerClient = previous })
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	if _, err := checkDocker(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected the check to time out, got %v", err)
+	}
+
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("expected the check to stop at the deadline, took %s", elapsed)
+	}
+}
+
+func TestCheckSTS(t *testing.T) {
+	defer func(client *sts.Client, sources []*sourceCredentials, local bool) {
+		stsService, sourceCredentialsList, isLocalMode = client, sources, local
+	}(stsService, sourceCredentialsList, isLocalMode)
+	isLocalMode = false
+
+	tests := []struct {
+		name           string
+		hostDenied     bool
+		sourceDenied   bool
+		expectedStatus string
+	}{
+		{name: "all credentials work", expectedStatus: "ok"},
+		{name: "source credentials denied", sourceDenied: true, expectedStatus: "degraded"},
+		{name: "host credentials denied", hostDenied: true, expectedStatus: "fail"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var hostCalls, sourceCalls int
+			atomic.StoreInt64(&lastSTSSuccessTime, 0)
+			stsService = newFakeSTSClient(t, tt.hostDenied, &hostCalls)
+			sourceCredentialsList = []*sourceCredentials{{pattern: "012345678910", kind: "profile", client: newFakeSTSClient(t, tt.sourceDenied, &sourceCalls)}}
+
+			previous := readinessChecks
+			readinessChecks = map[string]func(ctx context.Context) (string, error){"sts": checkSTS}
+			defer func() { readinessChecks = previous }()
+
+			for i := 0; i < 2; i++ {
+				results, ready := runReadinessChecks(context.Background())
+				if status := results["sts"].Status; status != tt.expectedStatus {
+					t.Fatalf("expected %s, got %s (%s)", tt.expectedStatus, status, results["sts"].Error)
+				}
+
+				if expected := tt.expectedStatus != "fail"; ready != expected {
+					t.Errorf("expected ready to be %t", expected)
+				}
+			}
+
+			// a successful call is reused within READY_STS_SUCCESS_WINDOW, failures are retried on the next check
+			if !tt.hostDenied && hostCalls != 1 {
+				t.Errorf("expected a single host call, got %d", hostCalls)
+			}
+
+			if !tt.hostDenied && !tt.sourceDenied && sourceCalls != 1 {
+				t.Errorf("expected a single source call, got %d", sourceCalls)
+			}
+		})
+	}
+}
@@ -1,10 +1,14 @@
 package internal
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net/http"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/gorilla/mux"
@@ -39,6 +43,19 @@ func StarServer() {
 		ReadTimeout:  15 * time.Second,
 	}
 
+	if isAdminListenerOnly && adminAddr == "" {
+		log.Fatal("ADMIN_LISTENER_ONLY requires ADMIN_ADDR to be set")
+	}
+
+	// any container could inject or remove the simulated events without the admin token
+	if isEventSimulationEnabled && adminAuthToken == "" {
+		log.Fatal("ENABLE_EVENT_SIMULATION requires ADMIN_AUTH_TOKEN to be set")
+	}
+
+	if adminAddr != "" {
+		go startAdminServer()
+	}
+
 	if err := srv.ListenAndServe(); err != nil {
 		log.Fatal(err)
 	}
@@ -85,12 +102,39 @@ func configureRouter(r handlerFunc) http.Handler {
 	r.HandleFunc("/{api_version}/meta-data/iam/security-credentials/{requested_role}/", iamSecurityCredentialsForRole)
 	r.HandleFunc("/{api_version}/meta-data/iam/security-credentials", iamSecurityCredentialsName)
 	r.HandleFunc("/{api_version}/meta-data/iam/security-credentials/", iamSecurityCredentialsName)
+	if isECSCredentialsEnabled {
+		r.HandleFunc("/v2/credentials", ecsCredentialsHandler)
+		r.HandleFunc("/v2/credentials/{id}", ecsCredentialsHandler)
+	}
+	if isPodIdentityEnabled {
+		r.HandleFunc("/v1/credentials", podIdentityHandler)
+	}
+	if isContainerUserDataEnabled {
+		r.HandleFunc("/{api_version}/user-data", userDataHandler)
+		r.HandleFunc("/{api_version}/user-data/", userDataHandler)
+	}
+	if isInstanceTagsEnabled {
+		r.HandleFunc("/{api_version}/meta-data/tags/instance", instanceTagsHandler)
+		r.HandleFunc("/{api_version}/meta-data/tags/instance/", instanceTagsHandler)
+		r.HandleFunc("/{api_version}/meta-data/tags/instance/{tag_key}", instanceTagsHandler)
+	}
+	if isEventSimulationEnabled {
+		r.HandleFunc("/{api_version}/meta-data/spot/instance-action", simulatedEventsHandler)
+		r.HandleFunc("/{api_version}/meta-data/spot/termination-time", simulatedEventsHandler)
+		r.HandleFunc("/{api_version}/meta-data/events/recommendations/rebalance", simulatedEventsHandler)
+		r.HandleFunc("/{api_version}/meta-data/events/maintenance/scheduled", simulatedEventsHandler)
+	}
+	if isContainerIdentityDocumentEnabled {
+		r.HandleFunc("/{api_version}/dynamic/instance-identity/{document_type:document|signature|pkcs7}", instanceIdentityHandler)
+	}
+	if !isAdminListenerOnly {
+		configureAdminRoutes(r)
+	}
 	r.HandleFunc("/{api_version}/{rest:.*}", passthroughHandler)
-	r.HandleFunc("/metrics", metricsHandler)
 	r.HandleFunc("/favicon.ico", notFoundHandler)
 	r.HandleFunc("/{rest:.*}", passthroughHandler)
 	r.HandleFunc("/", passthroughHandler)
-	return r
+	return withAccessControl(r)
 }
 
 // handles: /{api_version}/meta-data/iam/info
@@ -113,7 +157,7 @@ func iamInfoHandler(w http.ResponseWriter, r *http.Request) {
 	// read the role from AWS
 	roleInfo, externalID, err := findAWSRoleInformation(r.RemoteAddr, request)
 	if err != nil {
-		request.HandleError(err, 404, "could_not_find_container", w)
+		request.HandleError(err, errorKindNotFound, "could_not_find_container", w)
 		return
 	}
 
@@ -121,9 +165,9 @@ func iamInfoHandler(w http.ResponseWriter, r *http.Request) {
 	request.setLabel("role_name", *roleInfo.RoleName)
 
 	// assume the role
-	assumeRole, err := assumeRoleFromAWS(*roleInfo.Arn, externalID, request)
+	assumeRole, err := assumeRoleFromAWS(*roleInfo.Arn, externalID, request.container, request)
 	if err != nil {
-		request.HandleError(err, 404, "could_not_assume_role", w)
+		request.HandleError(err, errorKindInternal, "could_not_assume_role", w)
 		return
 	}
 
@@ -158,7 +202,7 @@ func iamSecurityCredentialsName(w http.ResponseWriter, r *http.Request) {
 	// read the role from AWS
 	roleInfo, _, err := findAWSRoleInformation(r.RemoteAddr, request)
 	if err != nil {
-		request.HandleError(err, 404, "could_not_find_container", w)
+		request.HandleError(err, errorKindNotFound, "could_not_find_container", w)
 		return
 	}
 
@@ -192,24 +236,33 @@ func iamSecurityCredentialsForRole(w http.ResponseWriter, r *http.Request) {
 	// read the role from AWS
 	roleInfo, externalID, err := findAWSRoleInformation(r.RemoteAddr, request)
 	if err != nil {
-		request.HandleError(err, 404, "could_not_find_container", w)
+		request.HandleError(err, errorKindNotFound, "could_not_find_container", w)
 		return
 	}
 
 	// verify the requested role match the container role
 	if vars["requested_role"] != *roleInfo.RoleName {
 		err := fmt.Errorf("Role names do not match (requested: '%s' vs container role: '%s')", vars["requested_role"], *roleInfo.RoleName)
-		request.HandleError(err, 404, "role_names_do_not_match", w)
+		request.HandleError(err, errorKindNotFound, "role_names_do_not_match", w)
 		return
 	}
 
 	// assume the container role
-	assumeRole, err := assumeRoleFromAWS(*roleInfo.Arn, externalID, request)
+	assumeRole, err := assumeRoleFromAWS(*roleInfo.Arn, externalID, request.container, request)
 	if err != nil {
-		request.HandleError(err, 404, "could_not_assume_role", w)
+		request.HandleError(err, errorKindInternal, "could_not_assume_role", w)
+		return
+	}
+
+	// compare the credentials with earlier requests for them
+	if err := detectCredentialAnomalies(request, *roleInfo.Arn, assumeRole); err != nil {
+		request.HandleError(err, errorKindForbidden, "anomaly_detected", w)
 		return
 	}
 
+	// record the credentials in the audit log
+	auditCredentialsIssued(request, *roleInfo.Arn, assumeRole)
+
 	// build response
 	response := map[string]string{
 		"Code":            "Success",
@@ -226,6 +279,304 @@ func iamSecurityCredentialsForRole(w http.ResponseWriter, r *http.Request) {
 	sendJSONResponse(w, response)
 }
 
+// handles: /v2/credentials
+// handles: /v2/credentials/{id}
+func ecsCredentialsHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	request := NewRequest(r, "ecs-credentials", "/v2/credentials/{id}")
+	request.jsonErrors = true
+	request.setLabel("ecs.credentials_id", vars["id"])
+	request.log.Infof("Handling %s from %s", r.URL.String(), remoteIP(r.RemoteAddr))
+	defer request.incrCounterWithLabels([]string{"http_request"}, 1)
+
+	// publish specific go-metadataproxy headers
+	request.setResponseHeaders(w)
+
+	// read the role from AWS
+	roleInfo, externalID, err := findAWSRoleInformation(r.RemoteAddr, request)
+	if err != nil {
+		request.HandleError(err, errorKindNotFound, "could_not_find_container", w)
+		return
+	}
+
+	// append role name to future telemetry
+	request.setLabel("role_name", *roleInfo.RoleName)
+
+	// verify the Authorization header against the container token
+	if err := verifyECSAuthorization(request.container, r.Header.Get("Authorization")); err != nil {
+		request.HandleError(err, errorKindForbidden, "invalid_authorization", w)
+		return
+	}
+
+	// assume the container role
+	assumeRole, err := assumeRoleFromAWS(*roleInfo.Arn, externalID, request.container, request)
+	if err != nil {
+		request.HandleError(err, errorKindInternal, "could_not_assume_role", w)
+		return
+	}
+
+	// compare the credentials with earlier requests for them
+	if err := detectCredentialAnomalies(request, *roleInfo.Arn, assumeRole); err != nil {
+		request.HandleError(err, errorKindForbidden, "anomaly_detected", w)
+		return
+	}
+
+	// record the credentials in the audit log
+	auditCredentialsIssued(request, *roleInfo.Arn, assumeRole)
+
+	// build response
+	response := map[string]string{
+		"RoleArn":         *roleInfo.Arn,
+		"AccessKeyId":     *assumeRole.Credentials.AccessKeyId,
+		"SecretAccessKey": *assumeRole.Credentials.SecretAccessKey,
+		"Token":           *assumeRole.Credentials.SessionToken,
+		"Expiration":      assumeRole.Credentials.Expiration.Format(awsTimeLayoutResponse),
+	}
+
+	// send response
+	request.setLabel("response_code", "200")
+	sendJSONResponse(w, response)
+}
+
+// handles: /v1/credentials
+func podIdentityHandler(w http.ResponseWriter, r *http.Request) {
+	request := NewRequest(r, "pod-identity", "/v1/credentials")
+	request.jsonErrors = true
+	request.log.Infof("Handling %s from %s", r.URL.String(), remoteIP(r.RemoteAddr))
+	defer request.incrCounterWithLabels([]string{"http_request"}, 1)
+
+	// publish specific go-metadataproxy headers
+	request.setResponseHeaders(w)
+
+	// find the role of the caller
+	roleInfo, externalID, err := findPodIdentityRole(r, request)
+	if err != nil {
+		request.HandleError(err, errorKindForbidden, "could_not_identify_caller", w)
+		return
+	}
+
+	// append role name to future telemetry
+	request.setLabel("role_name", *roleInfo.RoleName)
+
+	// assume the role
+	assumeRole, err := assumeRoleFromAWS(*roleInfo.Arn, externalID, request.container, request)
+	if err != nil {
+		request.HandleError(err, errorKindInternal, "could_not_assume_role", w)
+		return
+	}
+
+	// compare the credentials with earlier requests for them
+	if err := detectCredentialAnomalies(request, *roleInfo.Arn, assumeRole); err != nil {
+		request.HandleError(err, errorKindForbidden, "anomaly_detected", w)
+		return
+	}
+
+	// record the credentials in the audit log
+	auditCredentialsIssued(request, *roleInfo.Arn, assumeRole)
+
+	accountID := ""
+	if parsed, ok := parseRoleARN(*roleInfo.Arn); ok {
+		accountID = parsed.AccountID
+	}
+
+	// build response
+	response := map[string]string{
+		"AccessKeyId":     *assumeRole.Credentials.AccessKeyId,
+		"SecretAccessKey": *assumeRole.Credentials.SecretAccessKey,
+		"Token":           *assumeRole.Credentials.SessionToken,
+		"AccountId":       accountID,
+		"Expiration":      assumeRole.Credentials.Expiration.Format(awsTimeLayoutResponse),
+	}
+
+	// send response
+	request.setLabel("response_code", "200")
+	sendJSONResponse(w, response)
+}
+
+// handles: /{api_version}/dynamic/instance-identity/document
+// handles: /{api_version}/dynamic/instance-identity/signature
+// handles: /{api_version}/dynamic/instance-identity/pkcs7
+func instanceIdentityHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	request := NewRequest(r, "instance-identity", "/dynamic/instance-identity/{document_type}")
+	request.log.Infof("Handling %s from %s", r.URL.String(), remoteIP(r.RemoteAddr))
+	defer request.incrCounterWithLabels([]string{"http_request"}, 1)
+
+	// publish specific go-metadataproxy headers
+	request.setResponseHeaders(w)
+
+	// ensure we got compatible api version
+	if !isCompatibleAPIVersion(r) {
+		request.log.Warn("Request is using too old version of meta-data API, passing through directly")
+		passthroughHandler(w, r)
+		return
+	}
+
+	// find the container
+	container, err := findContainerInformation(r.RemoteAddr, request, request.datadogSpan)
+	if err != nil {
+		request.HandleError(err, errorKindNotFound, "could_not_find_container", w)
+		return
+	}
+
+	// build the container identity document
+	document, err := containerIdentityDocument(container, request)
+	if err != nil {
+		request.HandleError(err, errorKindInternal, "could_not_build_identity_document", w)
+		return
+	}
+
+	var response string
+	switch vars["document_type"] {
+	case "signature":
+		response, err = signIdentityDocument(document)
+	case "pkcs7":
+		response, err = signIdentityDocumentPKCS7(document)
+	default:
+		response = string(document)
+	}
+
+	if err != nil {
+		request.HandleError(err, errorKindInternal, "could_not_sign_identity_document", w)
+		return
+	}
+
+	// send response
+	request.setLabel("response_code", "200")
+	w.Header().Set("Content-Type", "text/plain")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(response))
+}
+
+// handles: /{api_version}/user-data
+func userDataHandler(w http.ResponseWriter, r *http.Request) {
+	request := NewRequest(r, "user-data", "/user-data")
+	request.log.Infof("Handling %s from %s", r.URL.String(), remoteIP(r.RemoteAddr))
+	defer request.incrCounterWithLabels([]string{"http_request"}, 1)
+
+	// publish specific go-metadataproxy headers
+	request.setResponseHeaders(w)
+
+	// ensure we got compatible api version
+	if !isCompatibleAPIVersion(r) {
+		request.log.Warn("Request is using too old version of meta-data API, passing through directly")
+		passthroughHandler(w, r)
+		return
+	}
+
+	// find the container
+	container, err := findContainerInformation(r.RemoteAddr, request, request.datadogSpan)
+	if err != nil {
+		request.HandleError(err, errorKindNotFound, "could_not_find_container", w)
+		return
+	}
+
+	// find the container user-data
+	userData, ok, err := findContainerUserData(container)
+	if err != nil {
+		request.HandleError(err, errorKindInternal, "could_not_read_user_data", w)
+		return
+	}
+
+	if !ok {
+		request.HandleError(fmt.Errorf("No user-data configured for container %s", container.ID), errorKindNotFound, "no_user_data", w)
+		return
+	}
+
+	// send response
+	request.setLabel("response_code", "200")
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.WriteHeader(http.StatusOK)
+	w.Write(userData)
+}
+
+// handles: /{api_version}/meta-data/tags/instance
+// handles: /{api_version}/meta-data/tags/instance/{tag_key}
+func instanceTagsHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	request := NewRequest(r, "instance-tags", "/meta-data/tags/instance/{tag_key}")
+	request.log.Infof("Handling %s from %s", r.URL.String(), remoteIP(r.RemoteAddr))
+	defer request.incrCounterWithLabels([]string{"http_request"}, 1)
+
+	// publish specific go-metadataproxy headers
+	request.setResponseHeaders(w)
+
+	// ensure we got compatible api version
+	if !isCompatibleAPIVersion(r) {
+		request.log.Warn("Request is using too old version of meta-data API, passing through directly")
+		passthroughHandler(w, r)
+		return
+	}
+
+	// find the container
+	container, err := findContainerInformation(r.RemoteAddr, request, request.datadogSpan)
+	if err != nil {
+		request.HandleError(err, errorKindNotFound, "could_not_find_container", w)
+		return
+	}
+
+	tags := findContainerInstanceTags(container, request)
+
+	response := renderInstanceTagsListing(tags)
+	if key, ok := vars["tag_key"]; ok {
+		if response, ok = tags[key]; !ok {
+			request.HandleError(fmt.Errorf("Could not find instance tag %s", key), errorKindNotFound, "tag_not_found", w)
+			return
+		}
+	}
+
+	// send response
+	request.setLabel("response_code", "200")
+	w.Header().Set("Content-Type", "text/plain")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(response))
+}
+
+// handles: /{api_version}/meta-data/spot/instance-action
+// handles: /{api_version}/meta-data/spot/termination-time
+// handles: /{api_version}/meta-data/events/recommendations/rebalance
+// handles: /{api_version}/meta-data/events/maintenance/scheduled
+func simulatedEventsHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	path := strings.TrimPrefix(r.URL.Path, "/"+vars["api_version"]+"/meta-data/")
+
+	request := NewRequest(r, "simulated-events", "/meta-data/"+path)
+	request.log.Infof("Handling %s from %s", r.URL.String(), remoteIP(r.RemoteAddr))
+	defer request.incrCounterWithLabels([]string{"http_request"}, 1)
+
+	// publish specific go-metadataproxy headers
+	request.setResponseHeaders(w)
+
+	// try to find the container, if this fail only global events will be served
+	container, _ := findContainerInformation(r.RemoteAddr, request, request.datadogSpan)
+
+	// without any simulated events, the upstream response is used
+	response, ok := renderSimulatedEvents(path, container)
+	if !ok {
+		servePassthrough(w, r, request)
+		return
+	}
+
+	body, ok := response.(string)
+	if !ok {
+		data, err := json.Marshal(response)
+		if err != nil {
+			request.HandleError(err, errorKindInternal, "could_not_encode_event", w)
+			return
+		}
+		body = string(data)
+	}
+
+	// send response
+	request.setLabel("response_code", "200")
+	w.Header().Set("Content-Type", "text/plain")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(body))
+}
+
 // handles: /*
 func passthroughHandler(w http.ResponseWriter, r *http.Request) {
 	request := NewRequest(r, "passthrough", r.URL.String())
@@ -235,36 +586,101 @@ func passthroughHandler(w http.ResponseWriter, r *http.Request) {
 	// publish specific go-metadataproxy headers
 	request.setResponseHeaders(w)
 
+	servePassthrough(w, r, request)
+}
+
+// servePassthrough proxies the request to the upstream IMDS (or the metadata document), for handlers falling back to
+// the upstream response with their own Request
+func servePassthrough(w http.ResponseWriter, r *http.Request, request *Request) {
 	// try to enrich the telemetry with additional labels
 	// if this fail, we will still proxy the request as-is
-	findAWSRoleInformation(r.RemoteAddr, request)
+	_, _, roleErr := findAWSRoleInformation(r.RemoteAddr, request)
+
+	// callers on untrusted networks get no metadata at all in deny mode
+	if errors.Is(roleErr, errUntrustedNetwork) && untrustedNetworkMode == "deny" {
+		request.HandleError(roleErr, errorKindForbidden, "untrusted_network", w)
+		return
+	}
+
+	// serve the metadata from the document rather than the upstream IMDS
+	if isMetadataEmulated {
+		serveMetadataDocument(w, r, request, roleErr == nil)
+		return
+	}
+
+	// serve static metadata from the cache (the key is taken before the URL is rewritten to the upstream URL)
+	cacheTTL, cacheable := passthroughCacheTTL(r, request)
+	cacheKey := passthroughCacheKey(r)
+	if cacheable {
+		// the IMDSv2 token is validated by the upstream, so unknown tokens are sent upstream first
+		if cached, ok := passthroughCache.Get(cacheKey); ok && isPassthroughTokenAccepted(r) {
+			request.setLabel("passthrough.cache", "hit")
+			request.incrCounterWithLabels([]string{"passthrough_cache"}, 1)
+			writeCachedPassthroughResponse(w, r, request, cached.(*cachedPassthroughResponse))
+			return
+		}
+
+		request.setLabel("passthrough.cache", "miss")
+		request.incrCounterWithLabels([]string{"passthrough_cache"}, 1)
+	}
 
 	r.RequestURI = ""
 
-	// ensure the chema and correct IP is set
+	// ensure the schema and upstream host is set
 	if r.URL.Scheme == "" {
-		r.URL.Scheme = "http"
-		r.URL.Host = "169.254.169.254"
-		r.Host = "169.254.169.254"
-	}
-	r.WithContext(tracer.ContextWithSpan(r.Context(), request.datadogSpan))
-
-	// create HTTP client
-	tp := newTransport()
-	client := &http.Client{Transport: tp}
-	defer func() {
-		request.setGaugeWithLabels([]string{"aws_response_time"}, float32(tp.Duration()))
-		request.setGaugeWithLabels([]string{"aws_request_time"}, float32(tp.ReqDuration()))
-		request.setGaugeWithLabels([]string{"aws_connection_time"}, float32(tp.ConnDuration()))
-	}()
+		upstream := upstreamURL(r.URL.Path)
+		r.URL.Scheme = upstream.Scheme
+		r.URL.Host = upstream.Host
+		r.URL.Path = upstream.Path
+		r.Host = upstream.Host
+	}
+	r = r.WithContext(tracer.ContextWithSpan(r.Context(), request.datadogSpan))
+
+	// hop-by-hop headers are only meaningful for the connection between the client and go-metadataproxy
+	removeHopByHopHeaders(r.Header)
+
 	// use the incoming http request to construct upstream request
-	resp, err := client.Do(r)
+	resp, timing, err := doUpstreamRequest(r)
+	request.setGaugeWithLabels([]string{"aws_response_time"}, float32(timing.Duration()))
+	request.setGaugeWithLabels([]string{"aws_request_time"}, float32(timing.ReqDuration()))
+	request.setGaugeWithLabels([]string{"aws_connection_time"}, float32(timing.ConnDuration()))
 	if err != nil {
-		request.HandleError(err, 404, "could_not_assume_role", w)
+		request.HandleError(err, errorKindInternal, "could_not_reach_upstream", w)
 		return
 	}
 	defer resp.Body.Close()
 
+	if cacheable {
+		recordPassthroughToken(r, resp.StatusCode)
+	}
+
+	// copy the upstream headers (Content-Type, ETag, Last-Modified, ...) to the response
+	removeHopByHopHeaders(resp.Header)
+
+	// store successful GET responses in the cache (HEAD responses have no body)
+	if cacheable && r.Method == http.MethodGet && resp.StatusCode == http.StatusOK {
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			request.HandleError(err, errorKindInternal, "could_not_read_upstream_response", w)
+			return
+		}
+
+		cached := &cachedPassthroughResponse{statusCode: resp.StatusCode, header: resp.Header, body: body}
+		passthroughCache.Set(cacheKey, cached, cacheTTL)
+		writeCachedPassthroughResponse(w, r, request, cached)
+		return
+	}
+
+	copyHeaders(w.Header(), resp.Header)
+
+	// answer conditional requests, in case the upstream didn't
+	if resp.StatusCode == http.StatusOK && etagMatches(r.Header.Get("If-None-Match"), resp.Header.Get("ETag")) {
+		request.setLabel("response_code", fmt.Sprintf("%v", http.StatusNotModified))
+		w.Header().Del("Content-Length")
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
 	w.WriteHeader(resp.StatusCode)
 	io.Copy(w, resp.Body)
 
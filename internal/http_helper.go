@@ -1,9 +1,15 @@
 package internal
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
 	"net"
 	"net/http"
+	"net/http/httptrace"
+	"net/url"
 	"strings"
 	"time"
 
@@ -11,18 +17,68 @@ import (
 	"github.com/cenkalti/backoff"
 	docker "github.com/fsouza/go-dockerclient"
 	"github.com/gorilla/mux"
-	httptrace "gopkg.in/DataDog/dd-trace-go.v1/contrib/net/http"
+	log "github.com/sirupsen/logrus"
+	ddhttp "gopkg.in/DataDog/dd-trace-go.v1/contrib/net/http"
 	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/tracer"
 )
 
+var (
+	upstreamBaseURL = parseUpstreamURL(getenvDefault("METADATA_UPSTREAM_URL", "http://169.254.169.254"))
+	upstreamClient  = newUpstreamClient()
+)
+
+func parseUpstreamURL(value string) *url.URL {
+	result, err := url.Parse(value)
+	if err != nil || result.Scheme == "" || result.Host == "" {
+		log.Fatalf("Invalid value for METADATA_UPSTREAM_URL: %s", value)
+	}
+
+	return result
+}
+
+// remoteIP returns the IP of the address (e.g. 172.17.0.2:41234 or [fd00::1]:41234)
 func remoteIP(addr string) string {
-	return strings.Split(addr, ":")[0]
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return strings.Trim(addr, "[]")
+	}
+
+	return host
+}
+
+// localAddr returns the local address the request was received on
+func localAddr(r *http.Request) net.Addr {
+	addr, _ := r.Context().Value(http.LocalAddrContextKey).(net.Addr)
+	return addr
 }
 
 func findAWSRoleInformation(addr string, request *Request) (*iam.Role, string, error) {
 	span := tracer.StartSpan("findAWSRoleInformation", tracer.ChildOf(request.datadogSpan.Context()))
 	defer span.Finish()
 
+	container, err := findContainerInformation(addr, request, span)
+	if err != nil {
+		return nil, "", err
+	}
+
+	roleName, err := findDockerContainerIAMRole(container, request)
+	if err != nil {
+		span.Finish(tracer.WithError(err))
+		return nil, "", err
+	}
+
+	role, err := readRoleFromAWS(roleName, request, span)
+	if err != nil {
+		span.Finish(tracer.WithError(err))
+		return nil, "", err
+	}
+
+	externalID := findDockerContainerexternalID(container, request)
+
+	return role, externalID, nil
+}
+
+func findContainerInformation(addr string, request *Request, parentSpan tracer.Span) (*docker.Container, error) {
 	var container *docker.Container
 
 	// retry finding the Docker container since sometimes Docker doesn't actually list the container until its been
@@ -35,7 +91,14 @@ func findAWSRoleInformation(addr string, request *Request) (*iam.Role, string, e
 
 	retryable := func() error {
 		var err error
-		container, err = findDockerContainer(remoteIP, request, span)
+		container, err = findDockerContainer(remoteIP, request, parentSpan)
+
+		// the networks of a container don't change, and denied (e.g. ambiguous) callers won't be allowed by waiting,
+		// so there is no point in retrying
+		if errors.Is(err, errUntrustedNetwork) || (err != nil && classifyError(err, errorKindNotFound) == errorKindForbidden) {
+			return backoff.Permanent(err)
+		}
+
 		return err
 	}
 
@@ -45,24 +108,61 @@ func findAWSRoleInformation(addr string, request *Request) (*iam.Role, string, e
 
 	err := backoff.RetryNotify(retryable, b, notify)
 	if err != nil {
-		return nil, "", err
+		return nil, err
 	}
 
-	roleName, err := findDockerContainerIAMRole(container, request)
-	if err != nil {
-		span.Finish(tracer.WithError(err))
-		return nil, "", err
-	}
+	recordContainerLookup()
+	return container, nil
+}
 
-	role, err := readRoleFromAWS(roleName, request, span)
-	if err != nil {
-		span.Finish(tracer.WithError(err))
-		return nil, "", err
-	}
+// fetchUpstreamMetadata reads the path (e.g. /latest/dynamic/instance-identity/document) from the upstream IMDS, using
+// an IMDSv2 session token
+func fetchUpstreamMetadata(path string, request *Request) ([]byte, error) {
+	span := tracer.StartSpan("fetchUpstreamMetadata", tracer.ChildOf(request.datadogSpan.Context()))
+	defer span.Finish()
+	span.SetTag("http.url", path)
 
-	externalID := findDockerContainerexternalID(container, request)
+	ctx, cancel := context.WithTimeout(tracer.ContextWithSpan(context.Background(), span), 5*time.Second)
+	defer cancel()
 
-	return role, externalID, nil
+	// a cached token could have been invalidated (e.g. by an instance stop), so a rejected token is replaced once
+	for attempt := 0; ; attempt++ {
+		token, err := upstreamSessionToken(ctx)
+		if err != nil {
+			span.Finish(tracer.WithError(err))
+			return nil, err
+		}
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, upstreamURL(path).String(), nil)
+		if err != nil {
+			span.Finish(tracer.WithError(err))
+			return nil, err
+		}
+
+		if token != "" {
+			req.Header.Set("X-aws-ec2-metadata-token", token)
+		}
+
+		resp, _, err := doUpstreamRequest(req)
+		if err != nil {
+			span.Finish(tracer.WithError(err))
+			return nil, err
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode == http.StatusUnauthorized && attempt == 0 {
+			resetUpstreamSessionToken()
+			continue
+		}
+
+		if resp.StatusCode != http.StatusOK {
+			err := fmt.Errorf("Upstream metadata returned %d for %s", resp.StatusCode, path)
+			span.Finish(tracer.WithError(err))
+			return nil, err
+		}
+
+		return ioutil.ReadAll(resp.Body)
+	}
 }
 
 func isCompatibleAPIVersion(r *http.Request) bool {
@@ -71,64 +171,140 @@ func isCompatibleAPIVersion(r *http.Request) bool {
 }
 
 func sendJSONResponse(w http.ResponseWriter, response interface{}) {
+	sendJSONResponseWithStatus(w, http.StatusOK, response)
+}
+
+func sendJSONResponseWithStatus(w http.ResponseWriter, code int, response interface{}) {
 	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
-	w.WriteHeader(http.StatusOK)
+	w.WriteHeader(code)
 
 	encoder := json.NewEncoder(w)
 	encoder.SetIndent("", "  ")
 	encoder.Encode(response)
 }
 
-type customTransport struct {
-	rtp       http.RoundTripper
-	dialer    *net.Dialer
+// hopByHopHeaders are the headers that apply to a single connection, and must not be forwarded by proxies
+var hopByHopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Proxy-Connection",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// removeHopByHopHeaders removes the hop-by-hop headers, including the ones listed in the Connection header
+func removeHopByHopHeaders(header http.Header) {
+	for _, value := range header.Values("Connection") {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				header.Del(name)
+			}
+		}
+	}
+
+	for _, name := range hopByHopHeaders {
+		header.Del(name)
+	}
+}
+
+func copyHeaders(dst, src http.Header) {
+	for name, values := range src {
+		dst.Del(name)
+		for _, value := range values {
+			dst.Add(name, value)
+		}
+	}
+}
+
+// etagMatches returns true if the If-None-Match header matches the ETag (using weak comparison)
+func etagMatches(ifNoneMatch, etag string) bool {
+	if ifNoneMatch == "" || etag == "" {
+		return false
+	}
+
+	if strings.TrimSpace(ifNoneMatch) == "*" {
+		return true
+	}
+
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		if strings.TrimPrefix(strings.TrimSpace(candidate), "W/") == etag {
+			return true
+		}
+	}
+
+	return false
+}
+
+// upstreamTiming collects the connection and request timing of a single upstream request
+type upstreamTiming struct {
 	connStart time.Time
 	connEnd   time.Time
 	reqStart  time.Time
 	reqEnd    time.Time
 }
 
-func newTransport() *customTransport {
-	tr := &customTransport{
-		dialer: &net.Dialer{
+// newUpstreamClient returns the HTTP client (with a pooled transport) shared by all upstream metadata requests
+func newUpstreamClient() *http.Client {
+	transport := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
 			Timeout:   5 * time.Second,
 			KeepAlive: 5 * time.Second,
-		},
-	}
-
-	tr.rtp = &http.Transport{
-		Proxy:               http.ProxyFromEnvironment,
-		Dial:                tr.dial,
+		}).DialContext,
 		TLSHandshakeTimeout: 10 * time.Second,
+		MaxIdleConns:        100,
+		MaxIdleConnsPerHost: 100,
+		IdleConnTimeout:     90 * time.Second,
 	}
 
-	httptrace.WrapRoundTripper(tr)
-	return tr
+	return &http.Client{
+		Transport: ddhttp.WrapRoundTripper(transport),
+	}
 }
 
-func (tr *customTransport) RoundTrip(r *http.Request) (*http.Response, error) {
-	tr.reqStart = time.Now()
-	resp, err := tr.rtp.RoundTrip(r)
-	tr.reqEnd = time.Now()
-	return resp, err
-}
+// doUpstreamRequest sends the request to the upstream metadata service using the shared client, collecting the timing
+func doUpstreamRequest(r *http.Request) (*http.Response, *upstreamTiming, error) {
+	timing := &upstreamTiming{}
 
-func (tr *customTransport) dial(network, addr string) (net.Conn, error) {
-	tr.connStart = time.Now()
-	cn, err := tr.dialer.Dial(network, addr)
-	tr.connEnd = time.Now()
+	trace := &httptrace.ClientTrace{
+		ConnectStart: func(network, addr string) {
+			timing.connStart = time.Now()
+		},
+		ConnectDone: func(network, addr string, err error) {
+			timing.connEnd = time.Now()
+		},
+	}
+
+	r = r.WithContext(httptrace.WithClientTrace(r.Context(), trace))
+
+	timing.reqStart = time.Now()
+	resp, err := upstreamClient.Do(r)
+	timing.reqEnd = time.Now()
+
+	return resp, timing, err
+}
 
-	return cn, err
+// upstreamURL returns the URL of the path on the upstream metadata service
+func upstreamURL(path string) *url.URL {
+	result := *upstreamBaseURL
+	result.Path = strings.TrimRight(result.Path, "/") + path
+	return &result
 }
 
-func (tr *customTransport) ReqDuration() time.Duration {
-	return tr.Duration() - tr.ConnDuration()
+func (t *upstreamTiming) ReqDuration() time.Duration {
+	return t.Duration() - t.ConnDuration()
 }
 
-func (tr *customTransport) ConnDuration() time.Duration {
-	return tr.connEnd.Sub(tr.connStart)
+// ConnDuration is zero when an idle connection was reused
+func (t *upstreamTiming) ConnDuration() time.Duration {
+	return t.connEnd.Sub(t.connStart)
 }
 
-func (tr *customTransport) Duration() time.Duration {
-	return tr.reqEnd.Sub(tr.reqStart)
+func (t *upstreamTiming) Duration() time.Duration {
+	return t.reqEnd.Sub(t.reqStart)
 }
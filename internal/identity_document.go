@@ -0,0 +1,247 @@
+package internal
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	docker "github.com/fsouza/go-dockerclient"
+	"github.com/patrickmn/go-cache"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	isContainerIdentityDocumentEnabled = os.Getenv("ENABLE_CONTAINER_IDENTITY_DOCUMENT") != ""
+	identityDocumentCache              = cache.New(1*time.Hour, 15*time.Minute)
+	identityDocumentSigningKey         *rsa.PrivateKey
+	identityDocumentSigningCert        *x509.Certificate
+)
+
+// ConfigureIdentityDocument will load the key (and certificate) used to sign the per-container identity documents
+func ConfigureIdentityDocument() {
+	if !isContainerIdentityDocumentEnabled {
+		return
+	}
+
+	log.Info("Synthesizing per-container instance identity documents")
+
+	if file := os.Getenv("IDENTITY_DOCUMENT_SIGNING_KEY"); file != "" {
+		key, err := loadRSAPrivateKey(file)
+		if err != nil {
+			log.Fatalf("Could not load IDENTITY_DOCUMENT_SIGNING_KEY: %s", err.Error())
+		}
+		identityDocumentSigningKey = key
+	}
+
+	if file := os.Getenv("IDENTITY_DOCUMENT_SIGNING_CERT"); file != "" {
+		cert, err := loadCertificate(file)
+		if err != nil {
+			log.Fatalf("Could not load IDENTITY_DOCUMENT_SIGNING_CERT: %s", err.Error())
+		}
+		identityDocumentSigningCert = cert
+	}
+}
+
+// identityDocumentContainerFields are added to the host document, replacing any fields with the same name
+var identityDocumentContainerFields = []string{"containerId", "containerName", "containerImage", "containerImageId", "containerCreatedTime"}
+
+// containerIdentityDocument returns the instance identity document of the host, with container specific fields added
+func containerIdentityDocument(container *docker.Container, request *Request) ([]byte, error) {
+	document, err := hostIdentityDocument(request)
+	if err != nil {
+		return nil, err
+	}
+
+	values := []string{
+		container.ID,
+		strings.TrimPrefix(container.Name, "/"),
+		container.Config.Image,
+		container.Image,
+		container.Created.UTC().Format(awsTimeLayoutResponse),
+	}
+	for i, field := range identityDocumentContainerFields {
+		document[field] = values[i]
+	}
+
+	return json.MarshalIndent(document, "", "  ")
+}
+
+// hostIdentityDocument returns the instance identity document of the host, either from the metadata document
+// (when emulating the metadata) or from the upstream IMDS
+//
+// All fields of the host document are kept, including ones go-metadataproxy doesn't know about. The per-container
+// label overrides of the metadata document are never used, as containers could otherwise have any account, region or
+// instance signed
+func hostIdentityDocument(request *Request) (map[string]interface{}, error) {
+	if isMetadataEmulated {
+		node, ok := lookupMetadataDocument(metadataDocument, "dynamic/instance-identity/document")
+		if !ok {
+			return nil, fmt.Errorf("Could not find dynamic/instance-identity/document in the metadata document")
+		}
+
+		return parseMetadataIdentityDocument(node)
+	}
+
+	var data []byte
+	if cached, ok := identityDocumentCache.Get("host"); ok {
+		request.setLabel("identity_document.cache", "hit")
+		data = cached.([]byte)
+	} else {
+		request.setLabel("identity_document.cache", "miss")
+
+		var err error
+		data, err = fetchUpstreamMetadata("/latest/dynamic/instance-identity/document", request)
+		if err != nil {
+			return nil, err
+		}
+
+		identityDocumentCache.Set("host", data, cache.DefaultExpiration)
+	}
+
+	document, err := decodeIdentityDocument(data)
+	if err != nil {
+		return nil, fmt.Errorf("Could not parse the host instance identity document: %s", err.Error())
+	}
+
+	return document, nil
+}
+
+// decodeIdentityDocument decodes the JSON document, keeping numbers as they are written
+func decodeIdentityDocument(data []byte) (map[string]interface{}, error) {
+	document := make(map[string]interface{})
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(&document); err != nil {
+		return nil, err
+	}
+
+	return document, nil
+}
+
+// parseMetadataIdentityDocument parses the identity document in the metadata document, which is either a JSON
+// string or a YAML map
+func parseMetadataIdentityDocument(node interface{}) (map[string]interface{}, error) {
+	if fields, ok := node.(map[string]interface{}); ok {
+		document := make(map[string]interface{}, len(fields))
+		for key, value := range fields {
+			switch value.(type) {
+			case int, float64:
+				// unquoted YAML numbers lose leading zeros (e.g. in the account ID), so they are never guessed
+				return nil, fmt.Errorf("%s in dynamic/instance-identity/document must be quoted", key)
+			default:
+				document[key] = value
+			}
+		}
+
+		return document, nil
+	}
+
+	data, ok := node.(string)
+	if !ok {
+		return nil, fmt.Errorf("dynamic/instance-identity/document in the metadata document must be a JSON string or a map")
+	}
+
+	document, err := decodeIdentityDocument([]byte(data))
+	if err != nil {
+		return nil, fmt.Errorf("Could not parse dynamic/instance-identity/document in the metadata document: %s", err.Error())
+	}
+
+	return document, nil
+}
+
+// signIdentityDocument returns the base64 encoded SHA256 RSA signature of the document
+func signIdentityDocument(document []byte) (string, error) {
+	if identityDocumentSigningKey == nil {
+		return "", fmt.Errorf("No IDENTITY_DOCUMENT_SIGNING_KEY configured")
+	}
+
+	digest := sha256.Sum256(document)
+	signature, err := rsa.SignPKCS1v15(rand.Reader, identityDocumentSigningKey, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+
+	return wrapBase64(signature), nil
+}
+
+// signIdentityDocumentPKCS7 returns the base64 encoded PKCS#7 signature of the document (without PEM headers, like IMDS)
+func signIdentityDocumentPKCS7(document []byte) (string, error) {
+	if identityDocumentSigningKey == nil || identityDocumentSigningCert == nil {
+		return "", fmt.Errorf("No IDENTITY_DOCUMENT_SIGNING_KEY and IDENTITY_DOCUMENT_SIGNING_CERT configured")
+	}
+
+	signature, err := signPKCS7(document, identityDocumentSigningKey, identityDocumentSigningCert)
+	if err != nil {
+		return "", err
+	}
+
+	return wrapBase64(signature), nil
+}
+
+// wrapBase64 encodes data as base64 in lines of 64 characters
+func wrapBase64(data []byte) string {
+	encoded := base64.StdEncoding.EncodeToString(data)
+
+	lines := make([]string, 0, len(encoded)/64+1)
+	for len(encoded) > 64 {
+		lines = append(lines, encoded[:64])
+		encoded = encoded[64:]
+	}
+	lines = append(lines, encoded)
+
+	return strings.Join(lines, "\n")
+}
+
+func loadRSAPrivateKey(file string) (*rsa.PrivateKey, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s does not contain a PEM encoded key", file)
+	}
+
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s does not contain a RSA key", file)
+	}
+
+	return rsaKey, nil
+}
+
+func loadCertificate(file string) (*x509.Certificate, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s does not contain a PEM encoded certificate", file)
+	}
+
+	return x509.ParseCertificate(block.Bytes)
+}
@@ -0,0 +1,120 @@
+package internal
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	docker "github.com/fsouza/go-dockerclient"
+	yaml "gopkg.in/yaml.v2"
+)
+
+func TestContainerIdentityDocumentEmulated(t *testing.T) {
+	tests := []struct {
+		name     string
+		document string
+		wantErr  bool
+	}{
+		{
+			name: "yaml map",
+			document: `
+dynamic:
+  instance-identity:
+    document:
+      accountId: "012345678910"
+      region: us-east-1
+      instanceId: i-0123456789abcdef0
+      billingProducts:
+      kernelId:
+      someNewField: some-value
+      containerId: spoofed
+`,
+		},
+		{
+			name: "json string",
+			document: `
+dynamic:
+  instance-identity:
+    document: |
+      {"accountId": "012345678910", "region": "us-east-1", "instanceId": "i-0123456789abcdef0", "someNewField": "some-value"}
+`,
+		},
+		{
+			name: "unquoted account ID",
+			document: `
+dynamic:
+  instance-identity:
+    document:
+      accountId: 012345678910
+`,
+			wantErr: true,
+		},
+		{
+			name:     "missing document",
+			document: "meta-data: {}",
+			wantErr:  true,
+		},
+	}
+
+	defer func(emulated bool, document map[string]interface{}) {
+		isMetadataEmulated, metadataDocument = emulated, document
+	}(isMetadataEmulated, metadataDocument)
+	isMetadataEmulated = true
+
+	container := &docker.Container{
+		ID:      "4f1c6ad0c7c1",
+		Name:    "/my-service",
+		Image:   "sha256:0123",
+		Created: time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC),
+		Config: &docker.Config{
+			Image: "my-service:1.2.3",
+			Labels: map[string]string{
+				metadataOverrideLabelPrefix + "dynamic/instance-identity/document": `{"accountId": "999999999999", "region": "eu-west-1"}`,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var document map[string]interface{}
+			if err := yaml.Unmarshal([]byte(tt.document), &document); err != nil {
+				t.Fatal(err)
+			}
+			metadataDocument = normalizeMetadataDocument(document).(map[string]interface{})
+
+			data, err := containerIdentityDocument(container, nil)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got %s", data)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var result map[string]interface{}
+			if err := json.Unmarshal(data, &result); err != nil {
+				t.Fatal(err)
+			}
+
+			// the label override of the container must not be signed, unknown host fields are kept
+			expected := map[string]interface{}{
+				"accountId":            "012345678910",
+				"someNewField":         "some-value",
+				"region":               "us-east-1",
+				"instanceId":           "i-0123456789abcdef0",
+				"containerId":          "4f1c6ad0c7c1",
+				"containerName":        "my-service",
+				"containerImage":       "my-service:1.2.3",
+				"containerCreatedTime": "2021-06-01T12:00:00Z",
+			}
+			for key, value := range expected {
+				if result[key] != value {
+					t.Errorf("expected %s to be %v, got %v", key, value, result[key])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,120 @@
+package internal
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	docker "github.com/fsouza/go-dockerclient"
+	"github.com/patrickmn/go-cache"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	isInstanceTagsEnabled   = os.Getenv("ENABLE_INSTANCE_TAGS") != ""
+	instanceTagsLabelPrefix = getenvDefault("INSTANCE_TAGS_LABEL_PREFIX", "tag/")
+	instanceTagsSource      = getenvDefault("INSTANCE_TAGS_SOURCE", "labels")
+	hostTagsCache           = cache.New(5*time.Minute, 10*time.Minute)
+)
+
+// ConfigureInstanceTags will validate the instance tags configuration
+func ConfigureInstanceTags() {
+	if !isInstanceTagsEnabled {
+		return
+	}
+
+	log.Infof("Serving instance tags from %s with label prefix '%s'", instanceTagsSource, instanceTagsLabelPrefix)
+
+	switch instanceTagsSource {
+	case "labels", "merge":
+	default:
+		log.Fatalf("Invalid value for INSTANCE_TAGS_SOURCE: %s (labels or merge)", instanceTagsSource)
+	}
+}
+
+// findContainerInstanceTags returns the instance tags of the container, from the container labels with
+// INSTANCE_TAGS_LABEL_PREFIX, merged on top of the host tags when INSTANCE_TAGS_SOURCE=merge
+func findContainerInstanceTags(container *docker.Container, request *Request) map[string]string {
+	tags := make(map[string]string)
+
+	if instanceTagsSource == "merge" {
+		hostTags, err := findHostInstanceTags(container, request)
+		if err != nil {
+			request.log.Warnf("Could not read host instance tags: %s", err.Error())
+		}
+
+		for key, value := range hostTags {
+			tags[key] = value
+		}
+	}
+
+	for label, value := range container.Config.Labels {
+		if strings.HasPrefix(label, instanceTagsLabelPrefix) {
+			tags[strings.TrimPrefix(label, instanceTagsLabelPrefix)] = value
+		}
+	}
+
+	return tags
+}
+
+// findHostInstanceTags returns the instance tags of the host, from the metadata document (when emulating metadata)
+// or the upstream IMDS
+func findHostInstanceTags(container *docker.Container, request *Request) (map[string]string, error) {
+	tags := make(map[string]string)
+
+	if isMetadataEmulated {
+		node, ok := lookupMetadataDocument(containerMetadataDocument(container), "meta-data/tags/instance")
+		if !ok {
+			return tags, nil
+		}
+
+		if directory, ok := node.(map[string]interface{}); ok {
+			for key, value := range directory {
+				tags[key] = renderMetadataDocumentValue(value, false)
+			}
+		}
+
+		return tags, nil
+	}
+
+	if cached, ok := hostTagsCache.Get("host"); ok {
+		request.setLabel("instance_tags.cache", "hit")
+		return cached.(map[string]string), nil
+	}
+
+	request.setLabel("instance_tags.cache", "miss")
+
+	listing, err := fetchUpstreamMetadata("/latest/meta-data/tags/instance", request)
+	if err != nil {
+		return tags, err
+	}
+
+	for _, key := range strings.Split(string(listing), "\n") {
+		if key == "" {
+			continue
+		}
+
+		value, err := fetchUpstreamMetadata("/latest/meta-data/tags/instance/"+key, request)
+		if err != nil {
+			return tags, fmt.Errorf("Could not read host instance tag %s: %s", key, err.Error())
+		}
+
+		tags[key] = string(value)
+	}
+
+	hostTagsCache.Set("host", tags, cache.DefaultExpiration)
+	return tags, nil
+}
+
+// renderInstanceTagsListing lists the tag keys the way IMDS does (sorted, one per line)
+func renderInstanceTagsListing(tags map[string]string) string {
+	keys := make([]string, 0, len(tags))
+	for key := range tags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	return strings.Join(keys, "\n")
+}
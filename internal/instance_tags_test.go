@@ -0,0 +1,68 @@
+package internal
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	docker "github.com/fsouza/go-dockerclient"
+)
+
+func TestFindContainerInstanceTagsMerge(t *testing.T) {
+	// an upstream with HttpTokens=required
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/latest/api/token" && r.Method == http.MethodPut {
+			w.Write([]byte("session-token"))
+			return
+		}
+
+		if r.Header.Get("X-aws-ec2-metadata-token") != "session-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		switch r.URL.Path {
+		case "/latest/meta-data/tags/instance":
+			w.Write([]byte("Environment\nName"))
+		case "/latest/meta-data/tags/instance/Environment":
+			w.Write([]byte("production"))
+		case "/latest/meta-data/tags/instance/Name":
+			w.Write([]byte("host"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	base, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func(previous *url.URL, source string, emulated bool) {
+		upstreamBaseURL, instanceTagsSource, isMetadataEmulated = previous, source, emulated
+	}(upstreamBaseURL, instanceTagsSource, isMetadataEmulated)
+	upstreamBaseURL, instanceTagsSource, isMetadataEmulated = base, "merge", false
+
+	resetUpstreamSessionToken()
+	hostTagsCache.Flush()
+	defer resetUpstreamSessionToken()
+	defer hostTagsCache.Flush()
+
+	container := &docker.Container{ID: "web", Config: &docker.Config{Labels: map[string]string{"tag/Name": "web"}}}
+	request := NewRequest(httptest.NewRequest(http.MethodGet, "/latest/meta-data/tags/instance", nil), "test", "/test")
+
+	tags := findContainerInstanceTags(container, request)
+
+	expected := map[string]string{"Environment": "production", "Name": "web"}
+	if len(tags) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, tags)
+	}
+
+	for key, value := range expected {
+		if tags[key] != value {
+			t.Errorf("expected %s to be %s, got %s", key, value, tags[key])
+		}
+	}
+}
@@ -0,0 +1,163 @@
+package internal
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base32"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/arn"
+	"github.com/aws/aws-sdk-go-v2/aws/external"
+	"github.com/aws/aws-sdk-go-v2/service/iam"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/tracer"
+)
+
+var (
+	isLocalMode       = getenvDefault("MODE", "aws") == "local"
+	localAccountID    = getenvDefault("LOCAL_ACCOUNT_ID", "000000000000")
+	localCredentials  = getenvDefault("LOCAL_CREDENTIALS", "fake")
+	localRoleProfiles = getenvMap("LOCAL_ROLE_PROFILES")
+)
+
+// configureLocalAWS will setup local mode, where no AWS credentials or upstream IMDS are needed
+func configureLocalAWS() {
+	log.Infof("Running in local mode with %s credentials", localCredentials)
+
+	switch localCredentials {
+	case "fake", "profile":
+	default:
+		log.Fatalf("Invalid value for LOCAL_CREDENTIALS: %s (fake or profile)", localCredentials)
+	}
+
+	// there is no host region to detect the partition from, so AWS_PARTITION or AWS_REGION decide
+	awsPartition = findPartition(os.Getenv("AWS_REGION"))
+}
+
+// readRoleLocally constructs the IAM role in LOCAL_ACCOUNT_ID and the configured partition, since iam:GetRole isn't
+// available in local mode
+func readRoleLocally(role string) *iam.Role {
+	nameChunks := strings.Split(role, "/")
+
+	return &iam.Role{
+		Arn:      aws.String(fmt.Sprintf("arn:%s:iam::%s:role/%s", awsPartition.ID(), localAccountID, strings.TrimLeft(role, "/"))),
+		RoleName: aws.String(nameChunks[len(nameChunks)-1]),
+	}
+}
+
+// assumeRoleLocally returns credentials for the role from either the shared credentials file or generated fakes
+func assumeRoleLocally(roleArn string, request *Request, parentSpan tracer.Span) (*sts.AssumeRoleResponse, error) {
+	span := tracer.StartSpan("assumeRoleLocally", tracer.ChildOf(parentSpan.Context()))
+	defer span.Finish()
+
+	span.SetTag("aws.arn", roleArn)
+
+	request.log.Infof("Looking for local credentials for %s", roleArn)
+	if assumedRole, ok := permissionCache.Get(roleArn); ok {
+		request.setAssumeRoleCache(true)
+		request.log.Infof("Found local credentials for %s in cache", roleArn)
+		return assumedRole.(*sts.AssumeRoleResponse), nil
+	}
+
+	request.setAssumeRoleCache(false)
+
+	parsed, err := arn.Parse(roleArn)
+	if err != nil {
+		span.Finish(tracer.WithError(err))
+		return nil, err
+	}
+
+	roleName := parsed.Resource[strings.LastIndex(parsed.Resource, "/")+1:]
+
+	var credentials *sts.Credentials
+	switch localCredentials {
+	case "profile":
+		credentials, err = readLocalProfileCredentials(roleName)
+	default:
+		credentials, err = generateFakeCredentials()
+	}
+	if err != nil {
+		span.Finish(tracer.WithError(err))
+		return nil, err
+	}
+
+	assumedRole := &sts.AssumeRoleResponse{
+		AssumeRoleOutput: &sts.AssumeRoleOutput{
+			AssumedRoleUser: &sts.AssumedRoleUser{
+				Arn:           aws.String(fmt.Sprintf("arn:%s:sts::%s:assumed-role/%s/go-metadataproxy", parsed.Partition, parsed.AccountID, roleName)),
+				AssumedRoleId: aws.String(fmt.Sprintf("AROA%s:go-metadataproxy", randomKeyID(17))),
+			},
+			Credentials: credentials,
+		},
+	}
+
+	ttl := credentialsTTL(*assumedRole.Credentials.Expiration)
+	request.log.Infof("Will cache local credentials for %s in %s", roleArn, ttl.String())
+	permissionCache.Set(roleArn, assumedRole, ttl)
+	return assumedRole, nil
+}
+
+// readLocalProfileCredentials reads the credentials for the role from the shared credentials file, using the
+// profile from LOCAL_ROLE_PROFILES, or a profile with the same name as the role
+func readLocalProfileCredentials(roleName string) (*sts.Credentials, error) {
+	profile, ok := localRoleProfiles[roleName]
+	if !ok {
+		profile = roleName
+	}
+
+	cfg, err := external.LoadDefaultAWSConfig(external.WithSharedConfigProfile(profile))
+	if err != nil {
+		return nil, fmt.Errorf("Could not load profile '%s' for role %s: %s", profile, roleName, err.Error())
+	}
+
+	creds, err := cfg.Credentials.Retrieve(context.Background())
+	if err != nil {
+		return nil, fmt.Errorf("Could not read credentials from profile '%s' for role %s: %s", profile, roleName, err.Error())
+	}
+
+	expiration := time.Now().Add(time.Hour)
+	if creds.CanExpire {
+		expiration = creds.Expires
+	}
+
+	return &sts.Credentials{
+		AccessKeyId:     aws.String(creds.AccessKeyID),
+		SecretAccessKey: aws.String(creds.SecretAccessKey),
+		SessionToken:    aws.String(creds.SessionToken),
+		Expiration:      aws.Time(expiration),
+	}, nil
+}
+
+// generateFakeCredentials generates random credentials in the AWS format, e.g. for LocalStack
+func generateFakeCredentials() (*sts.Credentials, error) {
+	secret := make([]byte, 30)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+
+	token := make([]byte, 96)
+	if _, err := rand.Read(token); err != nil {
+		return nil, err
+	}
+
+	return &sts.Credentials{
+		AccessKeyId:     aws.String("ASIA" + randomKeyID(16)),
+		SecretAccessKey: aws.String(base64.StdEncoding.EncodeToString(secret)),
+		SessionToken:    aws.String(base64.StdEncoding.EncodeToString(token)),
+		Expiration:      aws.Time(time.Now().Add(time.Hour)),
+	}, nil
+}
+
+// randomKeyID returns n random characters in the alphabet used by AWS key IDs
+func randomKeyID(n int) string {
+	buf := make([]byte, n)
+	rand.Read(buf)
+
+	return base32.StdEncoding.EncodeToString(buf)[:n]
+}
@@ -0,0 +1,220 @@
+package internal
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+
+	docker "github.com/fsouza/go-dockerclient"
+	log "github.com/sirupsen/logrus"
+	yaml "gopkg.in/yaml.v2"
+)
+
+var (
+	metadataDocumentFile        = os.Getenv("METADATA_DOCUMENT")
+	metadataDocument            = map[string]interface{}{}
+	isMetadataEmulated          = isLocalMode || os.Getenv("ENABLE_METADATA_EMULATION") != ""
+	metadataOverrideLabelPrefix = getenvDefault("METADATA_OVERRIDE_LABEL_PREFIX", "imds/")
+)
+
+// ConfigureMetadataDocument will load the YAML document used to serve instance metadata without an upstream IMDS
+//
+// The document mirrors the metadata tree below the API version, e.g.
+//
+//	meta-data:
+//	  instance-id: i-0123456789abcdef0
+//	  placement:
+//	    region: us-east-1
+//	user-data: |
+//	  #!/bin/bash
+func ConfigureMetadataDocument() {
+	if !isMetadataEmulated {
+		return
+	}
+
+	if metadataDocumentFile == "" {
+		log.Warn("No METADATA_DOCUMENT configured, non-IAM metadata will not be available")
+		return
+	}
+
+	data, err := ioutil.ReadFile(metadataDocumentFile)
+	if err != nil {
+		log.Fatalf("Could not read METADATA_DOCUMENT: %s", err.Error())
+	}
+
+	var document map[string]interface{}
+	if err := yaml.Unmarshal(data, &document); err != nil {
+		log.Fatalf("Could not parse METADATA_DOCUMENT: %s", err.Error())
+	}
+
+	log.Infof("Loaded metadata document from %s", metadataDocumentFile)
+	metadataDocument = normalizeMetadataDocument(document).(map[string]interface{})
+}
+
+// normalizeMetadataDocument converts the YAML maps (which can have non-string keys) into string keyed maps
+func normalizeMetadataDocument(node interface{}) interface{} {
+	switch v := node.(type) {
+	case map[string]interface{}:
+		result := make(map[string]interface{}, len(v))
+		for key, child := range v {
+			result[key] = normalizeMetadataDocument(child)
+		}
+		return result
+
+	case map[interface{}]interface{}:
+		result := make(map[string]interface{}, len(v))
+		for key, child := range v {
+			result[fmt.Sprint(key)] = normalizeMetadataDocument(child)
+		}
+		return result
+
+	default:
+		return v
+	}
+}
+
+// lookupMetadataDocument returns the value at the path in the document, the path being
+// relative to the API version (e.g. meta-data/placement/region)
+func lookupMetadataDocument(document map[string]interface{}, path string) (interface{}, bool) {
+	var node interface{} = document
+
+	for _, key := range splitMetadataPath(path) {
+		directory, ok := node.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+
+		if node, ok = directory[key]; !ok {
+			return nil, false
+		}
+	}
+
+	return node, true
+}
+
+// overrideMetadataDocument returns a copy of the document with the value at path replaced,
+// without modifying the original document
+func overrideMetadataDocument(document map[string]interface{}, path string, value interface{}) map[string]interface{} {
+	keys := splitMetadataPath(path)
+	if len(keys) == 0 {
+		return document
+	}
+
+	result := make(map[string]interface{}, len(document)+1)
+	for key, child := range document {
+		result[key] = child
+	}
+
+	if len(keys) == 1 {
+		result[keys[0]] = value
+		return result
+	}
+
+	child, _ := result[keys[0]].(map[string]interface{})
+	result[keys[0]] = overrideMetadataDocument(child, strings.Join(keys[1:], "/"), value)
+	return result
+}
+
+// containerMetadataDocument returns the metadata document with the overrides from the container labels applied
+//
+// e.g. the label "imds/meta-data/placement/region=eu-west-1" overrides meta-data/placement/region
+func containerMetadataDocument(container *docker.Container) map[string]interface{} {
+	document := metadataDocument
+	if container == nil || container.Config == nil {
+		return document
+	}
+
+	for label, value := range container.Config.Labels {
+		if strings.HasPrefix(label, metadataOverrideLabelPrefix) {
+			document = overrideMetadataDocument(document, strings.TrimPrefix(label, metadataOverrideLabelPrefix), value)
+		}
+	}
+
+	return document
+}
+
+func splitMetadataPath(path string) []string {
+	keys := make([]string, 0)
+	for _, key := range strings.Split(path, "/") {
+		if key != "" {
+			keys = append(keys, key)
+		}
+	}
+
+	return keys
+}
+
+// renderMetadataDocumentValue renders a node the way IMDS does: directories are listed one entry per line
+// (sub-directories with a trailing slash, except at the top level), and values are returned as-is
+func renderMetadataDocumentValue(node interface{}, topLevel bool) string {
+	switch v := node.(type) {
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for key, child := range v {
+			if _, ok := child.(map[string]interface{}); ok && !topLevel {
+				key = key + "/"
+			}
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		return strings.Join(keys, "\n")
+
+	case []interface{}:
+		items := make([]string, 0, len(v))
+		for _, item := range v {
+			items = append(items, fmt.Sprint(item))
+		}
+		return strings.Join(items, "\n")
+
+	case nil:
+		return ""
+
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// serveMetadataDocument serves the request from the metadata document instead of the upstream IMDS
+func serveMetadataDocument(w http.ResponseWriter, r *http.Request, request *Request, hasRole bool) {
+	path := r.URL.Path
+
+	// the root lists the available API versions
+	if path == "/" {
+		request.setLabel("response_code", "200")
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("latest"))
+		return
+	}
+
+	// strip the API version
+	if version, ok := request.vars["api_version"]; ok {
+		path = strings.TrimPrefix(path, "/"+version)
+	}
+
+	document := containerMetadataDocument(request.container)
+
+	// the IAM routes are served by go-metadataproxy itself, but should still be listed like IMDS does
+	if hasRole {
+		if metadata, ok := document["meta-data"].(map[string]interface{}); !ok || metadata["iam"] == nil {
+			document = overrideMetadataDocument(document, "meta-data/iam", map[string]interface{}{
+				"info":                 "",
+				"security-credentials": map[string]interface{}{},
+			})
+		}
+	}
+
+	node, ok := lookupMetadataDocument(document, path)
+	if !ok {
+		request.HandleError(fmt.Errorf("Could not find %s in the metadata document", path), errorKindNotFound, "not_found_in_metadata_document", w)
+		return
+	}
+
+	request.setLabel("response_code", "200")
+	w.Header().Set("Content-Type", "text/plain")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(renderMetadataDocumentValue(node, len(splitMetadataPath(path)) == 0)))
+}
@@ -0,0 +1,154 @@
+package internal
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/patrickmn/go-cache"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	isPassthroughCacheEnabled = os.Getenv("ENABLE_PASSTHROUGH_CACHE") != ""
+	passthroughCache          = cache.New(5*time.Minute, 10*time.Minute)
+	passthroughCacheRules     []passthroughCacheRule
+
+	// the IMDSv2 tokens (or no token, for IMDSv1) recently accepted by the upstream, as cached responses must only be
+	// served to requests the upstream would have answered
+	passthroughTokens = cache.New(1*time.Minute, 5*time.Minute)
+
+	// static metadata that never changes during the life time of an instance
+	defaultPassthroughCacheRules = "meta-data/ami-id=1h,meta-data/ami-launch-index=1h,meta-data/instance-id=1h,meta-data/instance-type=1h," +
+		"meta-data/local-hostname=1h,meta-data/local-ipv4=1h,meta-data/mac=1h,meta-data/placement/*=1h,dynamic/instance-identity/document=1h"
+
+	// dynamic metadata (and credentials) that must never be cached, regardless of the rules
+	passthroughCacheExcludedPrefixes = []string{
+		"meta-data/spot/",
+		"meta-data/events/",
+		"meta-data/iam/",
+		"meta-data/identity-credentials/",
+	}
+)
+
+// passthroughCacheRule caches upstream responses for paths (relative to the API version) matching the pattern
+type passthroughCacheRule struct {
+	pattern string
+	ttl     time.Duration
+}
+
+// cachedPassthroughResponse is an upstream response stored in the passthrough cache
+type cachedPassthroughResponse struct {
+	statusCode int
+	header     http.Header
+	body       []byte
+}
+
+// ConfigurePassthroughCache will parse the passthrough cache rules
+func ConfigurePassthroughCache() {
+	if !isPassthroughCacheEnabled {
+		return
+	}
+
+	rules := getenvDefault("PASSTHROUGH_CACHE_RULES", defaultPassthroughCacheRules)
+	for _, pair := range strings.Split(rules, ",") {
+		chunks := strings.SplitN(pair, "=", 2)
+		if len(chunks) != 2 {
+			log.Fatalf("Invalid value for PASSTHROUGH_CACHE_RULES: '%s' is not in path=ttl format", pair)
+		}
+
+		ttl, err := time.ParseDuration(strings.TrimSpace(chunks[1]))
+		if err != nil {
+			log.Fatalf("Invalid value for PASSTHROUGH_CACHE_RULES: %s", err.Error())
+		}
+
+		rule := passthroughCacheRule{pattern: strings.Trim(strings.TrimSpace(chunks[0]), "/"), ttl: ttl}
+		if _, err := path.Match(rule.pattern, ""); err != nil {
+			log.Fatalf("Invalid value for PASSTHROUGH_CACHE_RULES: '%s' is not a valid pattern", rule.pattern)
+		}
+
+		passthroughCacheRules = append(passthroughCacheRules, rule)
+	}
+
+	log.Infof("Caching passthrough responses with %d rules", len(passthroughCacheRules))
+}
+
+// passthroughCacheTTL returns how long the upstream response for the request can be cached,
+// and false if the response must not be cached
+func passthroughCacheTTL(r *http.Request, request *Request) (time.Duration, bool) {
+	if !isPassthroughCacheEnabled || (r.Method != http.MethodGet && r.Method != http.MethodHead) {
+		return 0, false
+	}
+
+	relativePath := strings.Trim(r.URL.Path, "/")
+	if version, ok := request.vars["api_version"]; ok {
+		relativePath = strings.Trim(strings.TrimPrefix(relativePath, version), "/")
+	}
+
+	for _, prefix := range passthroughCacheExcludedPrefixes {
+		if strings.HasPrefix(relativePath+"/", prefix) {
+			return 0, false
+		}
+	}
+
+	for _, rule := range passthroughCacheRules {
+		if ok, _ := path.Match(rule.pattern, relativePath); ok {
+			return rule.ttl, true
+		}
+	}
+
+	return 0, false
+}
+
+// passthroughCacheKey returns the cache key for the request (HEAD requests share the GET response)
+func passthroughCacheKey(r *http.Request) string {
+	return r.URL.RequestURI()
+}
+
+// passthroughTokenKey returns the key of the IMDSv2 token of the request (without storing the token itself)
+func passthroughTokenKey(r *http.Request) string {
+	token := r.Header.Get("X-aws-ec2-metadata-token")
+	if token == "" {
+		return "imdsv1"
+	}
+
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// isPassthroughTokenAccepted returns true if the upstream recently answered a request with the same IMDSv2 token
+// (or without a token, when IMDSv1 is allowed)
+func isPassthroughTokenAccepted(r *http.Request) bool {
+	_, ok := passthroughTokens.Get(passthroughTokenKey(r))
+	return ok
+}
+
+// recordPassthroughToken remembers whether the upstream accepted the IMDSv2 token of the request
+func recordPassthroughToken(r *http.Request, statusCode int) {
+	switch statusCode {
+	case http.StatusOK:
+		passthroughTokens.Set(passthroughTokenKey(r), true, cache.DefaultExpiration)
+	case http.StatusUnauthorized:
+		passthroughTokens.Delete(passthroughTokenKey(r))
+	}
+}
+
+// writeCachedPassthroughResponse writes the cached response, answering conditional requests
+func writeCachedPassthroughResponse(w http.ResponseWriter, r *http.Request, request *Request, cached *cachedPassthroughResponse) {
+	copyHeaders(w.Header(), cached.header)
+
+	if etagMatches(r.Header.Get("If-None-Match"), cached.header.Get("ETag")) {
+		request.setLabel("response_code", "304")
+		w.Header().Del("Content-Length")
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	request.setLabel("response_code", "200")
+	w.WriteHeader(cached.statusCode)
+	w.Write(cached.body)
+}
@@ -0,0 +1,139 @@
+package internal
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+func TestPassthroughCacheKey(t *testing.T) {
+	tests := []struct {
+		name     string
+		method   string
+		target   string
+		expected string
+	}{
+		{name: "path", method: http.MethodGet, target: "/latest/meta-data/instance-id", expected: "/latest/meta-data/instance-id"},
+		{name: "query", method: http.MethodGet, target: "/latest/meta-data/instance-id?a=b", expected: "/latest/meta-data/instance-id?a=b"},
+		{name: "head shares get", method: http.MethodHead, target: "/latest/meta-data/instance-id", expected: "/latest/meta-data/instance-id"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if key := passthroughCacheKey(httptest.NewRequest(tt.method, tt.target, nil)); key != tt.expected {
+				t.Errorf("expected %q, got %q", tt.expected, key)
+			}
+		})
+	}
+}
+
+// newPassthroughCacheTest serves the passthrough handler with the cache enabled, and an upstream at the base path
+func newPassthroughCacheTest(t *testing.T, basePath string, upstream http.HandlerFunc) (http.Handler, *int32) {
+	t.Helper()
+
+	newFakeDockerDaemon(t, newFakeContainer("web", "192.0.2.1"))
+
+	var hits int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		upstream(w, r)
+	}))
+	t.Cleanup(server.Close)
+
+	base, err := url.Parse(server.URL + basePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	previousBase, previousEnabled, previousRules, previousSkipped := upstreamBaseURL, isPassthroughCacheEnabled, passthroughCacheRules, isIngressVerificationSkipped
+	t.Cleanup(func() {
+		upstreamBaseURL, isPassthroughCacheEnabled, passthroughCacheRules, isIngressVerificationSkipped = previousBase, previousEnabled, previousRules, previousSkipped
+		passthroughCache.Flush()
+		passthroughTokens.Flush()
+	})
+
+	upstreamBaseURL, isPassthroughCacheEnabled, isIngressVerificationSkipped = base, true, true
+	passthroughCacheRules = []passthroughCacheRule{{pattern: "meta-data/instance-id", ttl: time.Hour}}
+	passthroughCache.Flush()
+	passthroughTokens.Flush()
+
+	r := mux.NewRouter()
+	r.HandleFunc("/{api_version}/{rest:.*}", passthroughHandler)
+	return r, &hits
+}
+
+func TestPassthroughCacheUpstreamBasePath(t *testing.T) {
+	router, hits := newPassthroughCacheTest(t, "/imds", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/imds/latest/meta-data/instance-id" {
+			http.NotFound(w, r)
+			return
+		}
+
+		w.Write([]byte("i-0123456789abcdef0"))
+	})
+
+	for i := 0; i < 3; i++ {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/latest/meta-data/instance-id", nil))
+
+		if w.Code != http.StatusOK || w.Body.String() != "i-0123456789abcdef0" {
+			t.Fatalf("expected the instance ID, got %d %q", w.Code, w.Body.String())
+		}
+	}
+
+	if *hits != 1 {
+		t.Errorf("expected a single upstream request, got %d", *hits)
+	}
+
+	if count := passthroughCache.ItemCount(); count != 1 {
+		t.Errorf("expected a single cache entry, got %d", count)
+	}
+}
+
+func TestPassthroughCacheIMDSv2Token(t *testing.T) {
+	// the upstream only accepts the "valid" token, like IMDS with IMDSv2 required
+	router, hits := newPassthroughCacheTest(t, "", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-aws-ec2-metadata-token") != "valid" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		w.Write([]byte("i-0123456789abcdef0"))
+	})
+
+	tests := []struct {
+		name         string
+		token        string
+		expectedCode int
+		expectedHits int32
+	}{
+		{name: "valid token fills the cache", token: "valid", expectedCode: http.StatusOK, expectedHits: 1},
+		{name: "valid token is served from the cache", token: "valid", expectedCode: http.StatusOK, expectedHits: 1},
+		{name: "missing token", token: "", expectedCode: http.StatusUnauthorized, expectedHits: 2},
+		{name: "invalid token", token: "invalid", expectedCode: http.StatusUnauthorized, expectedHits: 3},
+		{name: "invalid token again", token: "invalid", expectedCode: http.StatusUnauthorized, expectedHits: 4},
+	}
+
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/latest/meta-data/instance-id", nil)
+		if tt.token != "" {
+			r.Header.Set("X-aws-ec2-metadata-token", tt.token)
+		}
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+
+		if w.Code != tt.expectedCode {
+			t.Errorf("%s: expected %d, got %d", tt.name, tt.expectedCode, w.Code)
+		}
+
+		if *hits != tt.expectedHits {
+			t.Errorf("%s: expected %d upstream requests, got %d", tt.name, tt.expectedHits, *hits)
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package internal
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"math/big"
+)
+
+var (
+	oidPKCS7Data       = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 1}
+	oidPKCS7SignedData = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 2}
+	oidSHA256          = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 1}
+	oidRSAEncryption   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 1}
+)
+
+type pkcs7AlgorithmIdentifier struct {
+	Algorithm  asn1.ObjectIdentifier
+	Parameters asn1.RawValue `asn1:"optional"`
+}
+
+type pkcs7IssuerAndSerialNumber struct {
+	Issuer       asn1.RawValue
+	SerialNumber *big.Int
+}
+
+type pkcs7SignerInfo struct {
+	Version                   int
+	IssuerAndSerialNumber     pkcs7IssuerAndSerialNumber
+	DigestAlgorithm           pkcs7AlgorithmIdentifier
+	DigestEncryptionAlgorithm pkcs7AlgorithmIdentifier
+	EncryptedDigest           []byte
+}
+
+type pkcs7Data struct {
+	ContentType asn1.ObjectIdentifier
+	Content     []byte `asn1:"explicit,tag:0"`
+}
+
+type pkcs7SignedData struct {
+	Version          int
+	DigestAlgorithms []pkcs7AlgorithmIdentifier `asn1:"set"`
+	ContentInfo      pkcs7Data
+	Certificates     asn1.RawValue
+	SignerInfos      []pkcs7SignerInfo `asn1:"set"`
+}
+
+type pkcs7ContentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue
+}
+
+// signPKCS7 returns the DER encoded PKCS#7 SignedData of content (attached), signed with SHA256 and RSA
+func signPKCS7(content []byte, key *rsa.PrivateKey, cert *x509.Certificate) ([]byte, error) {
+	digest := sha256.Sum256(content)
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		return nil, err
+	}
+
+	sha256Algorithm := pkcs7AlgorithmIdentifier{Algorithm: oidSHA256, Parameters: asn1.NullRawValue}
+
+	signedData, err := asn1.Marshal(pkcs7SignedData{
+		Version:          1,
+		DigestAlgorithms: []pkcs7AlgorithmIdentifier{sha256Algorithm},
+		ContentInfo: pkcs7Data{
+			ContentType: oidPKCS7Data,
+			Content:     content,
+		},
+		Certificates: asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: cert.Raw},
+		SignerInfos: []pkcs7SignerInfo{
+			{
+				Version: 1,
+				IssuerAndSerialNumber: pkcs7IssuerAndSerialNumber{
+					Issuer:       asn1.RawValue{FullBytes: cert.RawIssuer},
+					SerialNumber: cert.SerialNumber,
+				},
+				DigestAlgorithm:           sha256Algorithm,
+				DigestEncryptionAlgorithm: pkcs7AlgorithmIdentifier{Algorithm: oidRSAEncryption, Parameters: asn1.NullRawValue},
+				EncryptedDigest:           signature,
+			},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return asn1.Marshal(pkcs7ContentInfo{
+		ContentType: oidPKCS7SignedData,
+		Content:     asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: signedData},
+	})
+}
@@ -0,0 +1,256 @@
+package internal
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/iam"
+	docker "github.com/fsouza/go-dockerclient"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	isPodIdentityEnabled   = os.Getenv("ENABLE_POD_IDENTITY") != ""
+	podIdentityCaller      = getenvDefault("POD_IDENTITY_CALLER", "ip")
+	podIdentityAudience    = os.Getenv("POD_IDENTITY_TOKEN_AUDIENCE")
+	podIdentityRoles       = getenvMap("POD_IDENTITY_ROLES")
+	podIdentityTokenPubKey *rsa.PublicKey
+
+	// the leeway (in seconds) for clock differences between go-metadataproxy and the token issuer
+	podIdentityClockSkew int64 = 60
+)
+
+// podIdentityClaims are the claims of a (projected service account) token used by the caller
+type podIdentityClaims struct {
+	Subject   string               `json:"sub"`
+	Audience  podIdentityAudiences `json:"aud"`
+	ExpiresAt int64                `json:"exp"`
+	NotBefore int64                `json:"nbf"`
+}
+
+// podIdentityAudiences is the "aud" claim, which can either be a string or a list of strings
+type podIdentityAudiences []string
+
+func (a *podIdentityAudiences) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*a = podIdentityAudiences{single}
+		return nil
+	}
+
+	var multiple []string
+	if err := json.Unmarshal(data, &multiple); err != nil {
+		return err
+	}
+
+	*a = multiple
+	return nil
+}
+
+// ConfigurePodIdentity will setup the EKS Pod Identity compatible endpoint
+func ConfigurePodIdentity() {
+	if !isPodIdentityEnabled {
+		return
+	}
+
+	log.Infof("Serving EKS Pod Identity credentials, identifying callers by %s", podIdentityCaller)
+
+	switch podIdentityCaller {
+	case "ip", "token":
+	default:
+		log.Fatalf("Invalid value for POD_IDENTITY_CALLER: %s (ip or token)", podIdentityCaller)
+	}
+
+	if file := os.Getenv("POD_IDENTITY_TOKEN_PUBLIC_KEY"); file != "" {
+		key, err := loadRSAPublicKey(file)
+		if err != nil {
+			log.Fatalf("Could not load POD_IDENTITY_TOKEN_PUBLIC_KEY: %s", err.Error())
+		}
+		podIdentityTokenPubKey = key
+	}
+
+	if podIdentityCaller == "token" && podIdentityTokenPubKey == nil {
+		log.Fatal("POD_IDENTITY_CALLER=token requires POD_IDENTITY_TOKEN_PUBLIC_KEY")
+	}
+}
+
+// findPodIdentityRole returns the role (and external ID) of the caller, either from the subject of the token
+// or from the container with the source IP
+func findPodIdentityRole(r *http.Request, request *Request) (*iam.Role, string, error) {
+	token := strings.TrimSpace(r.Header.Get("Authorization"))
+	if token == "" {
+		return nil, "", fmt.Errorf("Missing Authorization header")
+	}
+
+	if podIdentityTokenPubKey != nil {
+		claims, err := verifyPodIdentityToken(token)
+		if err != nil {
+			return nil, "", err
+		}
+
+		request.setLabel("pod_identity.subject", claims.Subject)
+
+		if podIdentityCaller == "token" {
+			role, ok := podIdentityRoles[claims.Subject]
+			if !ok {
+				return nil, "", fmt.Errorf("No role configured in POD_IDENTITY_ROLES for subject %s", claims.Subject)
+			}
+
+			roleInfo, err := readRoleFromAWS(role, request, request.datadogSpan)
+			return roleInfo, "", err
+		}
+	}
+
+	roleInfo, externalID, err := findAWSRoleInformation(r.RemoteAddr, request)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if err := verifyPodIdentityAuthorization(request.container, token); err != nil {
+		return nil, "", err
+	}
+
+	return roleInfo, externalID, nil
+}
+
+// verifyPodIdentityAuthorization verifies the token matches the AWS_CONTAINER_AUTHORIZATION_TOKEN_FILE of the container
+func verifyPodIdentityAuthorization(container *docker.Container, token string) error {
+	file, ok := findDockerContainerEnvValue(container, "AWS_CONTAINER_AUTHORIZATION_TOKEN_FILE")
+	if !ok || file == "" {
+		return fmt.Errorf("Container has no AWS_CONTAINER_AUTHORIZATION_TOKEN_FILE")
+	}
+
+	expected, err := readDockerContainerFile(container, file)
+	if err != nil {
+		return fmt.Errorf("Could not read AWS_CONTAINER_AUTHORIZATION_TOKEN_FILE from container: %s", err.Error())
+	}
+
+	if subtle.ConstantTimeCompare([]byte(strings.TrimSpace(string(expected))), []byte(token)) != 1 {
+		return fmt.Errorf("Authorization header does not match the container AWS_CONTAINER_AUTHORIZATION_TOKEN_FILE")
+	}
+
+	return nil
+}
+
+// verifyPodIdentityToken verifies the RS256 signature, validity and audience of the token, and returns its claims
+func verifyPodIdentityToken(token string) (*podIdentityClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("Authorization token is not a JWT")
+	}
+
+	var header struct {
+		Algorithm string `json:"alg"`
+	}
+	if err := decodeJWTSegment(parts[0], &header); err != nil {
+		return nil, err
+	}
+
+	if header.Algorithm != "RS256" {
+		return nil, fmt.Errorf("Unsupported token algorithm %s", header.Algorithm)
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("Could not decode token signature: %s", err.Error())
+	}
+
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(podIdentityTokenPubKey, crypto.SHA256, digest[:], signature); err != nil {
+		return nil, fmt.Errorf("Invalid token signature: %s", err.Error())
+	}
+
+	claims := &podIdentityClaims{}
+	if err := decodeJWTSegment(parts[1], claims); err != nil {
+		return nil, err
+	}
+
+	if claims.ExpiresAt == 0 {
+		return nil, fmt.Errorf("Token for %s has no expiration", claims.Subject)
+	}
+
+	now := time.Now().Unix()
+	if now >= claims.ExpiresAt+podIdentityClockSkew {
+		return nil, fmt.Errorf("Token for %s has expired", claims.Subject)
+	}
+
+	if claims.NotBefore != 0 && now < claims.NotBefore-podIdentityClockSkew {
+		return nil, fmt.Errorf("Token for %s is not valid yet", claims.Subject)
+	}
+
+	if podIdentityAudience != "" && !claims.Audience.contains(podIdentityAudience) {
+		return nil, fmt.Errorf("Token for %s does not have audience %s", claims.Subject, podIdentityAudience)
+	}
+
+	return claims, nil
+}
+
+func (a podIdentityAudiences) contains(audience string) bool {
+	for _, v := range a {
+		if v == audience {
+			return true
+		}
+	}
+
+	return false
+}
+
+func decodeJWTSegment(segment string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return fmt.Errorf("Could not decode token: %s", err.Error())
+	}
+
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("Could not parse token: %s", err.Error())
+	}
+
+	return nil
+}
+
+func loadRSAPublicKey(file string) (*rsa.PublicKey, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s does not contain a PEM encoded key", file)
+	}
+
+	var key interface{}
+	switch block.Type {
+	case "CERTIFICATE":
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		key = cert.PublicKey
+
+	default:
+		key, err = x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	rsaKey, ok := key.(*rsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("%s does not contain a RSA key", file)
+	}
+
+	return rsaKey, nil
+}
@@ -0,0 +1,87 @@
+package internal
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestVerifyPodIdentityToken(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func(pubKey *rsa.PublicKey, audience string) {
+		podIdentityTokenPubKey, podIdentityAudience = pubKey, audience
+	}(podIdentityTokenPubKey, podIdentityAudience)
+	podIdentityTokenPubKey, podIdentityAudience = &key.PublicKey, "pods.eks.amazonaws.com"
+
+	sign := func(signer *rsa.PrivateKey, algorithm string, claims map[string]interface{}) string {
+		encode := func(v interface{}) string {
+			data, err := json.Marshal(v)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return base64.RawURLEncoding.EncodeToString(data)
+		}
+
+		unsigned := encode(map[string]string{"alg": algorithm, "typ": "JWT"}) + "." + encode(claims)
+		digest := sha256.Sum256([]byte(unsigned))
+		signature, err := rsa.SignPKCS1v15(rand.Reader, signer, crypto.SHA256, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return unsigned + "." + base64.RawURLEncoding.EncodeToString(signature)
+	}
+
+	now := time.Now().Unix()
+	tests := []struct {
+		name    string
+		token   string
+		wantErr bool
+	}{
+		{name: "valid", token: sign(key, "RS256", map[string]interface{}{"sub": "pod", "aud": "pods.eks.amazonaws.com", "exp": now + 3600})},
+		{name: "audience list", token: sign(key, "RS256", map[string]interface{}{"sub": "pod", "aud": []string{"sts.amazonaws.com", "pods.eks.amazonaws.com"}, "exp": now + 3600})},
+		{name: "expired within clock skew", token: sign(key, "RS256", map[string]interface{}{"sub": "pod", "aud": "pods.eks.amazonaws.com", "exp": now - 30})},
+		{name: "not before within clock skew", token: sign(key, "RS256", map[string]interface{}{"sub": "pod", "aud": "pods.eks.amazonaws.com", "exp": now + 3600, "nbf": now + 30})},
+		{name: "missing expiration", token: sign(key, "RS256", map[string]interface{}{"sub": "pod", "aud": "pods.eks.amazonaws.com"}), wantErr: true},
+		{name: "expired", token: sign(key, "RS256", map[string]interface{}{"sub": "pod", "aud": "pods.eks.amazonaws.com", "exp": now - 300}), wantErr: true},
+		{name: "not valid yet", token: sign(key, "RS256", map[string]interface{}{"sub": "pod", "aud": "pods.eks.amazonaws.com", "exp": now + 3600, "nbf": now + 300}), wantErr: true},
+		{name: "wrong audience", token: sign(key, "RS256", map[string]interface{}{"sub": "pod", "aud": "sts.amazonaws.com", "exp": now + 3600}), wantErr: true},
+		{name: "other key", token: sign(otherKey, "RS256", map[string]interface{}{"sub": "pod", "aud": "pods.eks.amazonaws.com", "exp": now + 3600}), wantErr: true},
+		{name: "unsupported algorithm", token: sign(key, "none", map[string]interface{}{"sub": "pod", "aud": "pods.eks.amazonaws.com", "exp": now + 3600}), wantErr: true},
+		{name: "not a JWT", token: "not-a-token", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims, err := verifyPodIdentityToken(tt.token)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got claims %+v", claims)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if claims.Subject != "pod" {
+				t.Errorf("expected subject pod, got %s", claims.Subject)
+			}
+		})
+	}
+}
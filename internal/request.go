@@ -7,6 +7,7 @@ import (
 	"strings"
 
 	metrics "github.com/armon/go-metrics"
+	docker "github.com/fsouza/go-dockerclient"
 	"github.com/gorilla/mux"
 	uuid "github.com/satori/go.uuid"
 	"github.com/sirupsen/logrus"
@@ -25,10 +26,14 @@ type Request struct {
 	request       *http.Request
 	vars          map[string]string
 	id            string
+	handler       string
 	log           *logrus.Entry
 	metricsLabels []metrics.Label
 	loggingLabels logrus.Fields
 	datadogSpan   tracer.Span
+	container     *docker.Container
+	jsonErrors    bool
+	cachedRole    bool
 }
 
 func NewRequest(r *http.Request, name, path string) *Request {
@@ -39,6 +44,7 @@ func NewRequest(r *http.Request, name, path string) *Request {
 		request:       r,
 		vars:          mux.Vars(r),
 		id:            id.String(),
+		handler:       name,
 		log:           logrus.WithField("request.id", id.String()),
 		metricsLabels: make([]metrics.Label, 0),
 		loggingLabels: logrus.Fields{},
@@ -87,6 +93,18 @@ func (r *Request) setLabels(pairs map[string]string) {
 	}
 }
 
+// Set the assume role cache label, and remember if the credentials were served from the cache
+func (r *Request) setAssumeRoleCache(hit bool) {
+	r.cachedRole = hit
+
+	if hit {
+		r.setLabel("aws.cache.assume_role", "hit")
+		return
+	}
+
+	r.setLabel("aws.cache.assume_role", "miss")
+}
+
 // Set Trace tag details
 func (r *Request) setTraceTag(key, value string) {
 	if !isDataDogEnabled {
@@ -130,15 +148,20 @@ func (r *Request) setLabelsFromRequest() {
 	}
 }
 
-func (r *Request) HandleError(err error, code int, description string, w http.ResponseWriter) {
+// HandleError responds with the error, the kind is used unless the error itself carries a more specific one
+// (e.g. STS throttling or a Docker daemon failure)
+func (r *Request) HandleError(err error, kind errorKind, description string, w http.ResponseWriter) {
 	r.datadogSpan.Finish(tracer.WithError(err))
 
+	kind = classifyError(err, kind)
+
 	r.setLabels(map[string]string{
-		"response.code":     fmt.Sprintf("%d", code),
+		"response.code":     fmt.Sprintf("%d", kind.statusCode()),
+		"error.kind":        kind.String(),
 		"error.code":        description,
 		"error.description": err.Error(),
 	})
 
 	r.log.Error(err)
-	http.NotFound(w, nil)
+	writeErrorResponse(w, kind, description, err, r.jsonErrors)
 }
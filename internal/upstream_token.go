@@ -0,0 +1,69 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/patrickmn/go-cache"
+)
+
+const (
+	// upstreamTokenTTL is the lifetime requested for IMDSv2 session tokens (the maximum allowed by IMDS)
+	upstreamTokenTTL = 6 * time.Hour
+
+	// upstreamTokenRefresh is how long before it expires a session token is replaced
+	upstreamTokenRefresh = 5 * time.Minute
+)
+
+var (
+	upstreamTokenCache = cache.New(upstreamTokenTTL, 10*time.Minute)
+)
+
+// upstreamSessionToken returns an IMDSv2 session token for the requests go-metadataproxy makes to the upstream IMDS
+// itself, which is required on hosts with HttpTokens=required
+//
+// Upstreams without IMDSv2 support (e.g. mocks) get no token, which is remembered for a minute
+func upstreamSessionToken(ctx context.Context) (string, error) {
+	if token, ok := upstreamTokenCache.Get("token"); ok {
+		return token.(string), nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, upstreamURL("/latest/api/token").String(), nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", fmt.Sprintf("%d", int(upstreamTokenTTL.Seconds())))
+
+	resp, _, err := doUpstreamRequest(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound, http.StatusMethodNotAllowed:
+		upstreamTokenCache.Set("token", "", 1*time.Minute)
+		return "", nil
+	default:
+		return "", fmt.Errorf("Upstream metadata returned %d for an IMDSv2 session token", resp.StatusCode)
+	}
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+
+	token := strings.TrimSpace(string(data))
+	upstreamTokenCache.Set("token", token, upstreamTokenTTL-upstreamTokenRefresh)
+	return token, nil
+}
+
+// resetUpstreamSessionToken drops the cached session token, e.g. after the upstream rejected it
+func resetUpstreamSessionToken() {
+	upstreamTokenCache.Delete("token")
+}
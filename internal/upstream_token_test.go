@@ -0,0 +1,79 @@
+package internal
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestFetchUpstreamMetadataSessionToken(t *testing.T) {
+	tests := []struct {
+		name           string
+		supportsTokens bool
+		rotateToken    bool
+		expectedPuts   int
+	}{
+		{name: "tokens required", supportsTokens: true, expectedPuts: 1},
+		{name: "token rejected after a while", supportsTokens: true, rotateToken: true, expectedPuts: 2},
+		{name: "upstream without tokens", supportsTokens: false, expectedPuts: 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			puts, valid := 0, "token-0"
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path == "/latest/api/token" {
+					if !tt.supportsTokens || r.Method != http.MethodPut || r.Header.Get("X-aws-ec2-metadata-token-ttl-seconds") == "" {
+						http.NotFound(w, r)
+						return
+					}
+
+					puts++
+					valid = fmt.Sprintf("token-%d", puts)
+					w.Write([]byte(valid))
+					return
+				}
+
+				if tt.supportsTokens && r.Header.Get("X-aws-ec2-metadata-token") != valid {
+					w.WriteHeader(http.StatusUnauthorized)
+					return
+				}
+
+				w.Write([]byte(`{"accountId": "012345678910"}`))
+			}))
+			defer server.Close()
+
+			base, err := url.Parse(server.URL)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			defer func(previous *url.URL) { upstreamBaseURL = previous }(upstreamBaseURL)
+			upstreamBaseURL = base
+			resetUpstreamSessionToken()
+			defer resetUpstreamSessionToken()
+
+			request := NewRequest(httptest.NewRequest(http.MethodGet, "/latest/dynamic/instance-identity/document", nil), "test", "/test")
+			for i := 0; i < 3; i++ {
+				if i == 2 && tt.rotateToken {
+					valid = "expired"
+				}
+
+				data, err := fetchUpstreamMetadata("/latest/dynamic/instance-identity/document", request)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if string(data) != `{"accountId": "012345678910"}` {
+					t.Errorf("unexpected document %s", data)
+				}
+			}
+
+			if puts != tt.expectedPuts {
+				t.Errorf("expected %d session tokens, got %d", tt.expectedPuts, puts)
+			}
+		})
+	}
+}
@@ -0,0 +1,74 @@
+package internal
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	docker "github.com/fsouza/go-dockerclient"
+)
+
+var (
+	isContainerUserDataEnabled = os.Getenv("ENABLE_CONTAINER_USER_DATA") != ""
+	userDataLabel              = getenvDefault("USER_DATA_LABEL", "user-data")
+	userDataBase64Label        = getenvDefault("USER_DATA_BASE64_LABEL", "user-data-base64")
+	userDataFileLabel          = getenvDefault("USER_DATA_FILE_LABEL", "user-data-file")
+	userDataDirectory          = os.Getenv("USER_DATA_DIR")
+)
+
+// findContainerUserData returns the user-data of the container, looking (in order) at
+//
+//	the USER_DATA_LABEL label (as-is)
+//	the USER_DATA_BASE64_LABEL label (base64 decoded, for binary user-data)
+//	the file (inside the container) referenced by the USER_DATA_FILE_LABEL label
+//	the file named after the container in USER_DATA_DIR
+//	the user-data in the metadata document (when emulating metadata)
+//
+// The boolean is false if no user-data is configured for the container
+func findContainerUserData(container *docker.Container) ([]byte, bool, error) {
+	labels := container.Config.Labels
+
+	if v, ok := labels[userDataLabel]; ok {
+		return []byte(v), true, nil
+	}
+
+	if v, ok := labels[userDataBase64Label]; ok {
+		data, err := base64.StdEncoding.DecodeString(strings.TrimSpace(v))
+		if err != nil {
+			return nil, false, fmt.Errorf("Could not decode %s label: %s", userDataBase64Label, err.Error())
+		}
+
+		return data, true, nil
+	}
+
+	if v, ok := labels[userDataFileLabel]; ok {
+		data, err := readDockerContainerFile(container, v)
+		if err != nil {
+			return nil, false, fmt.Errorf("Could not read user-data file %s: %s", v, err.Error())
+		}
+
+		return data, true, nil
+	}
+
+	if userDataDirectory != "" {
+		data, err := ioutil.ReadFile(filepath.Join(userDataDirectory, filepath.Base(container.Name)))
+		if err == nil {
+			return data, true, nil
+		}
+
+		if !os.IsNotExist(err) {
+			return nil, false, err
+		}
+	}
+
+	if isMetadataEmulated {
+		if node, ok := lookupMetadataDocument(containerMetadataDocument(container), "user-data"); ok {
+			return []byte(renderMetadataDocumentValue(node, false)), true, nil
+		}
+	}
+
+	return nil, false, nil
+}
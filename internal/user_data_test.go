@@ -0,0 +1,72 @@
+package internal
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	docker "github.com/fsouza/go-dockerclient"
+)
+
+func TestFindContainerUserDataFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "metadataproxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// files outside of the mounts are read through the archive API, which doesn't know any container
+	daemon := httptest.NewServer(http.NotFoundHandler())
+	defer daemon.Close()
+
+	client, err := docker.NewClient(daemon.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dockerClient = client
+
+	mount := filepath.Join(dir, "mount")
+	mustWriteFile(t, filepath.Join(mount, "user-data"), "#!/bin/sh")
+	mustWriteFile(t, filepath.Join(dir, "signing.key"), "host secret")
+	mustSymlink(t, filepath.Join(dir, "signing.key"), filepath.Join(mount, "key"))
+
+	tests := []struct {
+		name     string
+		file     string
+		expected string
+		wantErr  bool
+	}{
+		{name: "file within mount", file: "/etc/app/user-data", expected: "#!/bin/sh"},
+		{name: "symlink to host file", file: "/etc/app/key", wantErr: true},
+		{name: "traversal out of mount", file: "/etc/app/../../" + filepath.Join(dir, "signing.key"), wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			container := &docker.Container{
+				ID:     "4f1c6ad0c7c1",
+				Config: &docker.Config{Labels: map[string]string{userDataFileLabel: tt.file}},
+				Mounts: []docker.Mount{{Source: mount, Destination: "/etc/app"}},
+			}
+
+			data, found, err := findContainerUserData(container)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got %q", data)
+				}
+				return
+			}
+
+			if err != nil || !found {
+				t.Fatalf("expected user-data, got %v (found: %t)", err, found)
+			}
+
+			if string(data) != tt.expected {
+				t.Errorf("expected %q, got %q", tt.expected, data)
+			}
+		})
+	}
+}
@@ -7,7 +7,14 @@ import (
 func main() {
 	internal.ConfigureLogging()
 	internal.ConfigureTelemetry()
+	internal.ConfigureAudit()
+	internal.ConfigureAnomalyDetection()
 	internal.ConfigureDocker()
+	internal.ConfigureMetadataDocument()
 	internal.ConfigureAWS()
+	internal.ConfigureIdentityDocument()
+	internal.ConfigurePodIdentity()
+	internal.ConfigureInstanceTags()
+	internal.ConfigurePassthroughCache()
 	internal.StarServer()
 }